@@ -0,0 +1,278 @@
+package acl
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"github.com/pilosus/goradieschen/store"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultUser is the user new connections are authenticated as when it needs no password
+const DefaultUser = "default"
+
+// user holds the access rules of a single user
+type user struct {
+	enabled bool
+	nopass  bool
+	// passwords holds the SHA-256 hashes of the passwords, in hex
+	passwords map[string]struct{}
+	// allCommands is the permission of the commands not listed in commands,
+	// which maps upper-cased command names to their permission
+	allCommands bool
+	commands    map[string]bool
+	allKeys     bool
+	keyPatterns []string
+}
+
+func newUser() *user {
+	return &user{passwords: make(map[string]struct{}), commands: make(map[string]bool)}
+}
+
+// ACL is the set of users along with their permissions
+type ACL struct {
+	mu    sync.RWMutex
+	users map[string]*user
+}
+
+// New creates an ACL with the default user, which is enabled, needs no password
+// and may run any command on any key
+func New() *ACL {
+	u := newUser()
+	u.enabled, u.nopass, u.allCommands, u.allKeys = true, true, true, true
+	return &ACL{users: map[string]*user{DefaultUser: u}}
+}
+
+// hashPassword returns the SHA-256 hash of the password, in hex
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// SetUser creates the user if it doesn't exist and applies the rules to it in order.
+// A new user is disabled and may run no command on no key until allowed by the rules.
+// The rules are on, off, >password, nopass, ~pattern, allkeys, +command, -command,
+// +@all (or allcommands) and -@all (or nocommands). No rule is applied if any is invalid.
+func (a *ACL) SetUser(name string, rules []string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	u := newUser()
+	if old, ok := a.users[name]; ok {
+		*u = *old
+		u.passwords = make(map[string]struct{}, len(old.passwords))
+		for hash := range old.passwords {
+			u.passwords[hash] = struct{}{}
+		}
+		u.commands = make(map[string]bool, len(old.commands))
+		for cmd, allowed := range old.commands {
+			u.commands[cmd] = allowed
+		}
+		u.keyPatterns = append([]string(nil), old.keyPatterns...)
+	}
+	for _, rule := range rules {
+		if err := u.apply(rule); err != nil {
+			return err
+		}
+	}
+	a.users[name] = u
+	return nil
+}
+
+// apply applies a single rule to the user
+func (u *user) apply(rule string) error {
+	switch lower := strings.ToLower(rule); {
+	case lower == "on":
+		u.enabled = true
+	case lower == "off":
+		u.enabled = false
+	case lower == "nopass":
+		u.nopass = true
+		u.passwords = make(map[string]struct{})
+	case lower == "allkeys" || rule == "~*":
+		u.allKeys = true
+		u.keyPatterns = nil
+	case lower == "allcommands" || lower == "+@all":
+		u.allCommands = true
+		u.commands = make(map[string]bool)
+	case lower == "nocommands" || lower == "-@all":
+		u.allCommands = false
+		u.commands = make(map[string]bool)
+	case strings.HasPrefix(rule, ">"):
+		u.nopass = false
+		u.passwords[hashPassword(rule[1:])] = struct{}{}
+	case strings.HasPrefix(rule, "~"):
+		if !u.allKeys {
+			u.keyPatterns = append(u.keyPatterns, rule[1:])
+		}
+	case len(rule) > 1 && (rule[0] == '+' || rule[0] == '-') && rule[1] != '@':
+		allowed := rule[0] == '+'
+		cmd := strings.ToUpper(rule[1:])
+		// Only the exceptions to the permission of all the other commands are kept
+		if allowed == u.allCommands {
+			delete(u.commands, cmd)
+		} else {
+			u.commands[cmd] = allowed
+		}
+	default:
+		return fmt.Errorf("Error in ACL SETUSER modifier '%s': Syntax error", rule)
+	}
+	return nil
+}
+
+// Authenticate reports whether the user exists, is enabled and the password is valid for it.
+// Any password is valid for a user with nopass.
+func (a *ACL) Authenticate(name, password string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	u, ok := a.users[name]
+	if !ok || !u.enabled {
+		return false
+	}
+	if u.nopass {
+		return true
+	}
+	hash := hashPassword(password)
+	for h := range u.passwords {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// NoPass reports whether the user exists, is enabled and needs no password
+func (a *ACL) NoPass(name string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	u, ok := a.users[name]
+	return ok && u.enabled && u.nopass
+}
+
+// CanRun reports whether the user may run the command, given by its upper-cased name
+func (a *ACL) CanRun(name, cmd string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	u, ok := a.users[name]
+	if !ok {
+		return false
+	}
+	if allowed, ok := u.commands[cmd]; ok {
+		return allowed
+	}
+	return u.allCommands
+}
+
+// CanAccess reports whether the user may access the key
+func (a *ACL) CanAccess(name, key string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	u, ok := a.users[name]
+	if !ok {
+		return false
+	}
+	if u.allKeys {
+		return true
+	}
+	for _, pattern := range u.keyPatterns {
+		if store.StringMatch(pattern, key, false) {
+			return true
+		}
+	}
+	return false
+}
+
+// Names returns the names of all users, sorted
+func (a *ACL) Names() []string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	names := make([]string, 0, len(a.users))
+	for name := range a.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Description is the access rules of a user, as reported by ACL GETUSER
+type Description struct {
+	// Flags holds on or off, and nopass
+	Flags []string
+	// Passwords holds the hashes of the passwords
+	Passwords []string
+	// Commands is the command rules, e.g. "-@all +get"
+	Commands string
+	// Keys is the key patterns, e.g. "~user:*"
+	Keys string
+}
+
+// Describe returns the access rules of the user
+func (a *ACL) Describe(name string) (Description, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	u, ok := a.users[name]
+	if !ok {
+		return Description{}, false
+	}
+
+	var d Description
+	if u.enabled {
+		d.Flags = append(d.Flags, "on")
+	} else {
+		d.Flags = append(d.Flags, "off")
+	}
+	if u.nopass {
+		d.Flags = append(d.Flags, "nopass")
+	}
+
+	d.Passwords = make([]string, 0, len(u.passwords))
+	for hash := range u.passwords {
+		d.Passwords = append(d.Passwords, hash)
+	}
+	sort.Strings(d.Passwords)
+
+	rules := []string{"-@all"}
+	if u.allCommands {
+		rules[0] = "+@all"
+	}
+	cmds := make([]string, 0, len(u.commands))
+	for cmd := range u.commands {
+		cmds = append(cmds, cmd)
+	}
+	sort.Strings(cmds)
+	for _, cmd := range cmds {
+		sign := "-"
+		if u.commands[cmd] {
+			sign = "+"
+		}
+		rules = append(rules, sign+strings.ToLower(cmd))
+	}
+	d.Commands = strings.Join(rules, " ")
+
+	if u.allKeys {
+		d.Keys = "~*"
+	} else {
+		keys := make([]string, 0, len(u.keyPatterns))
+		for _, pattern := range u.keyPatterns {
+			keys = append(keys, "~"+pattern)
+		}
+		d.Keys = strings.Join(keys, " ")
+	}
+	return d, true
+}
+
+// Rules renders the access rules of the user the way ACL LIST does
+func (d Description) Rules() string {
+	parts := append([]string{}, d.Flags...)
+	for _, hash := range d.Passwords {
+		parts = append(parts, "#"+hash)
+	}
+	if d.Keys != "" {
+		parts = append(parts, d.Keys)
+	}
+	parts = append(parts, d.Commands)
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,66 @@
+package acl
+
+import (
+	"testing"
+)
+
+func TestSetUser(t *testing.T) {
+	a := New()
+	if err := a.SetUser("alice", []string{"on", ">secret", "~user:*", "+get", "+SET"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		got      bool
+		expected bool
+	}{
+		{name: "valid password", got: a.Authenticate("alice", "secret"), expected: true},
+		{name: "invalid password", got: a.Authenticate("alice", "guess"), expected: false},
+		{name: "unknown user", got: a.Authenticate("bob", "secret"), expected: false},
+		{name: "allowed command", got: a.CanRun("alice", "GET"), expected: true},
+		{name: "allowed uppercase command", got: a.CanRun("alice", "SET"), expected: true},
+		{name: "denied command", got: a.CanRun("alice", "DEL"), expected: false},
+		{name: "matching key", got: a.CanAccess("alice", "user:1"), expected: true},
+		{name: "other key", got: a.CanAccess("alice", "admin:1"), expected: false},
+		{name: "default user runs anything", got: a.CanRun(DefaultUser, "FLUSHALL"), expected: true},
+		{name: "default user needs no password", got: a.NoPass(DefaultUser), expected: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, tt.got)
+			}
+		})
+	}
+}
+
+func TestSetUserRulesInOrder(t *testing.T) {
+	a := New()
+	_ = a.SetUser("bob", []string{"on", "nopass", "+@all", "-flushall"})
+	if !a.CanRun("bob", "GET") || a.CanRun("bob", "FLUSHALL") {
+		t.Errorf("expected all commands but FLUSHALL to be allowed")
+	}
+	_ = a.SetUser("bob", []string{"+flushall", "off"})
+	if !a.CanRun("bob", "FLUSHALL") {
+		t.Errorf("expected rules to be applied on top of the existing ones")
+	}
+	if a.Authenticate("bob", "") {
+		t.Errorf("expected a disabled user not to authenticate")
+	}
+	d, _ := a.Describe("bob")
+	if rules := d.Rules(); rules != "off nopass +@all" {
+		t.Errorf("expected the rules to be %q, got %q", "off nopass +@all", rules)
+	}
+}
+
+func TestSetUserInvalidRule(t *testing.T) {
+	a := New()
+	err := a.SetUser("carol", []string{"on", "+@string"})
+	if err == nil || err.Error() != "Error in ACL SETUSER modifier '+@string': Syntax error" {
+		t.Errorf("expected a syntax error, got %v", err)
+	}
+	if _, ok := a.Describe("carol"); ok {
+		t.Errorf("expected no user to be created on error")
+	}
+}
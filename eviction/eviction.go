@@ -0,0 +1,114 @@
+package eviction
+
+import (
+	"errors"
+	"fmt"
+	"github.com/pilosus/goradieschen/ttlstore"
+	"sync/atomic"
+	"time"
+)
+
+// Policy is the way keys are chosen for eviction once maxmemory is reached
+type Policy string
+
+const (
+	// NoEviction rejects writes instead of evicting keys
+	NoEviction Policy = "noeviction"
+	// VolatileLRU evicts the least recently used among the keys with a TTL
+	VolatileLRU Policy = "volatile-lru"
+	// VolatileTTL evicts the key with a TTL closest to expiring
+	VolatileTTL Policy = "volatile-ttl"
+	// VolatileRandom evicts a random key with a TTL
+	VolatileRandom Policy = "volatile-random"
+)
+
+// lruSamples is the number of keys sampled to approximate LRU, like maxmemory-samples in Redis
+const lruSamples = 5
+
+// ErrOOM is returned when used memory exceeds maxmemory and no key can be evicted
+var ErrOOM = errors.New("command not allowed when used memory > 'maxmemory'.")
+
+// ParsePolicy parses the name of an eviction policy
+func ParsePolicy(name string) (Policy, error) {
+	switch policy := Policy(name); policy {
+	case NoEviction, VolatileLRU, VolatileTTL, VolatileRandom:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown maxmemory policy: %s", name)
+	}
+}
+
+// Store is the part of the keyspace backend the evictor needs to pick victims
+type Store interface {
+	UsedMemory() int64
+	AccessedAt(key string) (time.Time, bool)
+}
+
+// Evictor keeps the dataset within the maxmemory limit
+type Evictor struct {
+	store     Store
+	ttl       *ttlstore.TTLStore
+	maxMemory atomic.Int64
+	policy    atomic.Value
+}
+
+// New creates an evictor with no memory limit and the noeviction policy
+func New(store Store, ttl *ttlstore.TTLStore) *Evictor {
+	e := &Evictor{store: store, ttl: ttl}
+	e.policy.Store(NoEviction)
+	return e
+}
+
+// SetMaxMemory sets the memory limit in bytes, zero disables the limit
+func (e *Evictor) SetMaxMemory(bytes int64) { e.maxMemory.Store(bytes) }
+func (e *Evictor) MaxMemory() int64         { return e.maxMemory.Load() }
+func (e *Evictor) SetPolicy(policy Policy)  { e.policy.Store(policy) }
+func (e *Evictor) Policy() Policy           { return e.policy.Load().(Policy) }
+
+// Evict calls evict with victims chosen by the policy until the used memory
+// fits into maxmemory. The evict function must remove both the key and its TTL. It returns ErrOOM if the limit is still exceeded,
+// but there are no keys left the policy is allowed to evict.
+func (e *Evictor) Evict(evict func(key string)) error {
+	limit := e.MaxMemory()
+	if limit <= 0 {
+		return nil
+	}
+	for e.store.UsedMemory() > limit {
+		key, ok := e.victim()
+		if !ok {
+			return ErrOOM
+		}
+		evict(key)
+	}
+	return nil
+}
+
+// victim chooses the next key to evict
+func (e *Evictor) victim() (string, bool) {
+	switch e.Policy() {
+	case VolatileTTL:
+		return e.ttl.Peek()
+	case VolatileRandom:
+		keys := e.ttl.Sample(1)
+		if len(keys) == 0 {
+			return "", false
+		}
+		return keys[0], true
+	case VolatileLRU:
+		var victim string
+		var oldest time.Time
+		for _, key := range e.ttl.Sample(lruSamples) {
+			accessed, ok := e.store.AccessedAt(key)
+			if !ok {
+				// The key is about to expire, evicting it drops its TTL entry as well
+				return key, true
+			}
+			if victim == "" || accessed.Before(oldest) {
+				victim, oldest = key, accessed
+			}
+		}
+		return victim, victim != ""
+	default:
+		return "", false
+	}
+}
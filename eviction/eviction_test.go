@@ -0,0 +1,65 @@
+package eviction
+
+import (
+	"context"
+	"github.com/pilosus/goradieschen/store"
+	"github.com/pilosus/goradieschen/ttlstore"
+	"testing"
+	"time"
+)
+
+func TestParsePolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected Policy
+		wantErr  bool
+	}{
+		{name: "noeviction", expected: NoEviction},
+		{name: "volatile-lru", expected: VolatileLRU},
+		{name: "volatile-ttl", expected: VolatileTTL},
+		{name: "volatile-random", expected: VolatileRandom},
+		{name: "allkeys-lru", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePolicy(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestEvictVolatileLRU(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := store.NewStore()
+	ttl := ttlstore.NewTTLStore(ctx, nil)
+	e := New(s, ttl)
+	e.SetPolicy(VolatileLRU)
+
+	s.SetMany([]string{"persistent", "value", "volatile", "value"})
+	ttl.SetTTL("volatile", time.Now().Add(time.Hour))
+	e.SetMaxMemory(s.UsedMemory() - 1)
+
+	var evicted []string
+	err := e.Evict(func(key string) {
+		evicted = append(evicted, key)
+		ttl.Remove(key)
+		s.Delete(key)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(evicted) != 1 || evicted[0] != "volatile" {
+		t.Errorf("expected only the volatile key to be evicted, got %v", evicted)
+	}
+
+	e.SetMaxMemory(1)
+	if err := e.Evict(func(key string) { t.Errorf("unexpected eviction of %s", key) }); err != ErrOOM {
+		t.Errorf("expected ErrOOM, got %v", err)
+	}
+}
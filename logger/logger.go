@@ -0,0 +1,102 @@
+package logger
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+type Level int32
+
+const (
+	DEBUG Level = iota
+	INFO
+	WARN
+	ERROR
+)
+
+var levelNames = map[Level]string{
+	DEBUG: "DEBUG",
+	INFO:  "INFO",
+	WARN:  "WARN",
+	ERROR: "ERROR",
+}
+
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("Level(%d)", int32(l))
+}
+
+// ParseLevel parses a case-insensitive level name such as "info" or "WARN"
+func ParseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	return INFO, fmt.Errorf("unknown log level: %q", name)
+}
+
+// Logger writes messages at or above its level, prefixed with the message level
+type Logger struct {
+	level atomic.Int32
+	out   *log.Logger
+}
+
+// New creates a logger writing to w messages at or above level
+func New(w io.Writer, level Level) *Logger {
+	l := &Logger{out: log.New(w, "", log.LstdFlags)}
+	l.SetLevel(level)
+	return l
+}
+
+func (l *Logger) SetLevel(level Level) {
+	l.level.Store(int32(level))
+}
+
+func (l *Logger) Level() Level {
+	return Level(l.level.Load())
+}
+
+// Enabled reports whether messages at level are written
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.Level()
+}
+
+func (l *Logger) logf(level Level, format string, args ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	l.out.Printf("["+level.String()+"] "+format, args...)
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) { l.logf(DEBUG, format, args...) }
+func (l *Logger) Infof(format string, args ...interface{})  { l.logf(INFO, format, args...) }
+func (l *Logger) Warnf(format string, args ...interface{})  { l.logf(WARN, format, args...) }
+func (l *Logger) Errorf(format string, args ...interface{}) { l.logf(ERROR, format, args...) }
+
+var std atomic.Pointer[Logger]
+
+func init() {
+	std.Store(New(os.Stderr, INFO))
+}
+
+// Default returns the logger used by the package-level functions
+func Default() *Logger {
+	return std.Load()
+}
+
+// SetDefault replaces the logger used by the package-level functions
+func SetDefault(l *Logger) {
+	std.Store(l)
+}
+
+func Debugf(format string, args ...interface{}) { Default().Debugf(format, args...) }
+func Infof(format string, args ...interface{})  { Default().Infof(format, args...) }
+func Warnf(format string, args ...interface{})  { Default().Warnf(format, args...) }
+func Errorf(format string, args ...interface{}) { Default().Errorf(format, args...) }
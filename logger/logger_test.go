@@ -0,0 +1,79 @@
+package logger
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLevelFiltering(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, WARN)
+
+	l.Debugf("debug %d", 1)
+	l.Infof("info %d", 2)
+	l.Warnf("warn %d", 3)
+	l.Errorf("error %d", 4)
+
+	out := buf.String()
+	for _, suppressed := range []string{"[DEBUG] debug 1", "[INFO] info 2"} {
+		if strings.Contains(out, suppressed) {
+			t.Errorf("expected %q to be suppressed, got %q", suppressed, out)
+		}
+	}
+	for _, written := range []string{"[WARN] warn 3", "[ERROR] error 4"} {
+		if !strings.Contains(out, written) {
+			t.Errorf("expected %q to be written, got %q", written, out)
+		}
+	}
+
+	buf.Reset()
+	l.SetLevel(DEBUG)
+	l.Debugf("now visible")
+	if !strings.Contains(buf.String(), "[DEBUG] now visible") {
+		t.Errorf("expected debug line after lowering the level, got %q", buf.String())
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected Level
+		wantErr  bool
+	}{
+		{input: "debug", expected: DEBUG},
+		{input: "INFO", expected: INFO},
+		{input: "Warn", expected: WARN},
+		{input: "error", expected: ERROR},
+		{input: "verbose", expected: INFO, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			level, err := ParseLevel(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error=%v, got %v", tt.wantErr, err)
+			}
+			if level != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, level)
+			}
+		})
+	}
+}
+
+func TestSetDefault(t *testing.T) {
+	previous := Default()
+	t.Cleanup(func() { SetDefault(previous) })
+
+	var buf bytes.Buffer
+	SetDefault(New(&buf, INFO))
+	Debugf("hidden")
+	Infof("client %s connected", "127.0.0.1:1234")
+
+	out := buf.String()
+	if strings.Contains(out, "hidden") {
+		t.Errorf("expected debug line to be suppressed, got %q", out)
+	}
+	if !strings.Contains(out, "[INFO] client 127.0.0.1:1234 connected") {
+		t.Errorf("expected info line, got %q", out)
+	}
+}
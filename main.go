@@ -1,20 +1,57 @@
 package main
 
 import (
-	"bufio"
 	"context"
+	"flag"
+	"github.com/pilosus/goradieschen/acl"
+	"github.com/pilosus/goradieschen/eviction"
+	"github.com/pilosus/goradieschen/logger"
+	"github.com/pilosus/goradieschen/metrics"
 	"github.com/pilosus/goradieschen/protocol"
+	"github.com/pilosus/goradieschen/replication"
 	"github.com/pilosus/goradieschen/server"
 	"github.com/pilosus/goradieschen/store"
 	"github.com/pilosus/goradieschen/ttlstore"
-	"log"
+	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 )
 
 func main() {
-	log.Print("Server initializing...")
+	replicaReadOnly := flag.Bool("replica-read-only", false, "reject write commands as a read-only replica")
+	logLevel := flag.String("loglevel", "info", "log level: debug, info, warn or error")
+	metricsAddr := flag.String("metrics-addr", "", "address to serve Prometheus metrics at /metrics on, e.g. :9121 (disabled if empty)")
+	maxMemory := flag.Int64("maxmemory", 0, "memory limit for the dataset in bytes (unlimited if 0)")
+	maxMemoryPolicy := flag.String("maxmemory-policy", "noeviction", "eviction policy: noeviction, volatile-lru, volatile-ttl or volatile-random")
+	bind := flag.String("bind", "", "space-separated list of interface addresses to listen on, e.g. \"127.0.0.1 ::1\" (all interfaces if empty)")
+	port := flag.Int("port", 6380, "port to listen on")
+	protoMaxBulkLen := flag.Int64("proto-max-bulk-len", protocol.DefaultProtoMaxBulkLen, "size limit of a single bulk string in a request in bytes")
+	protoMaxMultibulkLen := flag.Int64("proto-max-multibulk-len", protocol.DefaultProtoMaxMultibulkLen, "limit of the number of elements in a single request")
+	readBufferSize := flag.Int("read-buffer-size", server.DefaultReadBufferSize, "size of the per-connection read buffer in bytes")
+	expireCycleInterval := flag.Duration("active-expire-interval", 0, "run the background expiration in periodic cycles with the interval, e.g. 100ms (every key is expired precisely on time if 0)")
+	expireCycleBatch := flag.Int("active-expire-batch", 20, "maximum number of keys expired per periodic cycle")
+	flag.Parse()
+
+	level, err := logger.ParseLevel(*logLevel)
+	if err != nil {
+		logger.Errorf("%s", err)
+		os.Exit(1)
+	}
+	logger.Default().SetLevel(level)
+
+	policy, err := eviction.ParsePolicy(*maxMemoryPolicy)
+	if err != nil {
+		logger.Errorf("%s", err)
+		os.Exit(1)
+	}
+
+	protocol.SetProtoMaxBulkLen(*protoMaxBulkLen)
+	protocol.SetProtoMaxMultibulkLen(*protoMaxMultibulkLen)
+
+	logger.Infof("Server initializing...")
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -23,21 +60,45 @@ func main() {
 
 	s := store.NewStore()
 
-	ttl := ttlstore.NewTTLStore(
-		ctx,
-		func(key string) {
-			// Add logging callback for key expiration
-			log.Printf("Key expired: %s", key)
-			// Remove key from the main key store
-			s.Delete(key)
-		})
+	repl := replication.NewState()
+	repl.SetReadOnly(*replicaReadOnly)
+
+	// Keys expired in the background are deleted on replicas as well
+	var ttl *ttlstore.TTLStore
+	ttl = ttlstore.NewTTLStore(ctx, func(key string) {
+		protocol.ExpireKey(s, ttl, repl, key)
+	})
 	defer ttl.Stop()
+	ttl.SetExpireCycle(*expireCycleInterval, *expireCycleBatch)
+
+	evict := eviction.New(s, ttl)
+	evict.SetMaxMemory(*maxMemory)
+	evict.SetPolicy(policy)
+
+	users := acl.New()
+
+	if *metricsAddr != "" {
+		go func() {
+			if err := metrics.Default().Serve(ctx, *metricsAddr); err != nil {
+				logger.Errorf("Metrics server error: %s", err)
+			}
+		}()
+	}
+
+	addrs := []string{":" + strconv.Itoa(*port)}
+	if hosts := strings.Fields(*bind); len(hosts) > 0 {
+		addrs = addrs[:0]
+		for _, host := range hosts {
+			addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(*port)))
+		}
+	}
 
-	err := server.Start(ctx, ":6380", func(reader *bufio.Reader) string {
-		return protocol.ParseCommand(reader, s, ttl)
+	err = server.StartAll(ctx, addrs, *readBufferSize, func(conn net.Conn) server.Handler {
+		return protocol.NewSession(conn, s, ttl, repl, evict, users)
 	})
 	if err != nil {
-		log.Fatal(err)
+		logger.Errorf("%s", err)
+		os.Exit(1)
 	}
 }
 
@@ -47,7 +108,7 @@ func handleSignals(cancel context.CancelFunc) {
 
 	go func() {
 		<-sig
-		log.Println("Shutdown signal received...")
+		logger.Infof("Shutdown signal received...")
 		cancel()
 	}()
 }
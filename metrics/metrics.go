@@ -0,0 +1,199 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/pilosus/goradieschen/logger"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// namespace prefixes the names of all exported metrics
+const namespace = "goradieschen"
+
+// Collector keeps server metrics as atomic counters,
+// so that recording them on the command path never blocks.
+type Collector struct {
+	connectedClients atomic.Int64
+	// counters are swapped as a whole on Reset, so that readers never
+	// observe a mix of reset and non-reset statistics
+	counters atomic.Pointer[counters]
+}
+
+// counters holds the statistics zeroed by Reset
+type counters struct {
+	commandsProcessed atomic.Int64
+	keyspaceHits      atomic.Int64
+	keyspaceMisses    atomic.Int64
+	expiredKeys       atomic.Int64
+	evictedKeys       atomic.Int64
+	// commands maps a lower-cased command name to its *commandCounters
+	commands sync.Map
+}
+
+type commandCounters struct {
+	calls atomic.Int64
+	usec  atomic.Int64
+}
+
+// CommandStat holds the number of calls of a command and their cumulative duration
+type CommandStat struct {
+	Calls int64
+	Usec  int64
+}
+
+// UsecPerCall returns the average duration of a call in microseconds
+func (s CommandStat) UsecPerCall() float64 {
+	if s.Calls == 0 {
+		return 0
+	}
+	return float64(s.Usec) / float64(s.Calls)
+}
+
+func NewCollector() *Collector {
+	c := &Collector{}
+	c.counters.Store(&counters{})
+	return c
+}
+
+// Reset atomically zeroes the statistics. Gauges, such as the number of connected clients, are kept.
+func (c *Collector) Reset() {
+	c.counters.Store(&counters{})
+}
+
+// CommandProcessed records a call of the named command that took duration to execute
+func (c *Collector) CommandProcessed(name string, duration time.Duration) {
+	stats := c.counters.Load()
+	stats.commandsProcessed.Add(1)
+	name = strings.ToLower(name)
+	counters, ok := stats.commands.Load(name)
+	if !ok {
+		counters, _ = stats.commands.LoadOrStore(name, new(commandCounters))
+	}
+	counters.(*commandCounters).calls.Add(1)
+	counters.(*commandCounters).usec.Add(duration.Microseconds())
+}
+
+func (c *Collector) ClientConnected()    { c.connectedClients.Add(1) }
+func (c *Collector) ClientDisconnected() { c.connectedClients.Add(-1) }
+func (c *Collector) KeyspaceHit()        { c.counters.Load().keyspaceHits.Add(1) }
+func (c *Collector) KeyspaceMiss()       { c.counters.Load().keyspaceMisses.Add(1) }
+func (c *Collector) KeyExpired()         { c.counters.Load().expiredKeys.Add(1) }
+func (c *Collector) KeyEvicted()         { c.counters.Load().evictedKeys.Add(1) }
+
+func (c *Collector) CommandsProcessed() int64 { return c.counters.Load().commandsProcessed.Load() }
+func (c *Collector) ConnectedClients() int64  { return c.connectedClients.Load() }
+func (c *Collector) KeyspaceHits() int64      { return c.counters.Load().keyspaceHits.Load() }
+func (c *Collector) KeyspaceMisses() int64    { return c.counters.Load().keyspaceMisses.Load() }
+func (c *Collector) ExpiredKeys() int64       { return c.counters.Load().expiredKeys.Load() }
+func (c *Collector) EvictedKeys() int64       { return c.counters.Load().evictedKeys.Load() }
+
+// CommandStats returns the call statistics per lower-cased command name
+func (c *Collector) CommandStats() map[string]CommandStat {
+	stats := make(map[string]CommandStat)
+	c.counters.Load().commands.Range(func(name, counters interface{}) bool {
+		stats[name.(string)] = CommandStat{
+			Calls: counters.(*commandCounters).calls.Load(),
+			Usec:  counters.(*commandCounters).usec.Load(),
+		}
+		return true
+	})
+	return stats
+}
+
+// CommandNames returns the sorted names of the commands with recorded calls
+func (c *Collector) CommandNames() []string {
+	var names []string
+	c.counters.Load().commands.Range(func(name, _ interface{}) bool {
+		names = append(names, name.(string))
+		return true
+	})
+	sort.Strings(names)
+	return names
+}
+
+// WritePrometheus writes all metrics in the Prometheus text exposition format
+func (c *Collector) WritePrometheus(w io.Writer) error {
+	var b strings.Builder
+	writeMetric(&b, "commands_processed_total", "counter", "Total number of commands processed.", c.CommandsProcessed())
+
+	stats := c.CommandStats()
+	names := c.CommandNames()
+	fmt.Fprintf(&b, "# HELP %s_commands_total Number of calls per command.\n", namespace)
+	fmt.Fprintf(&b, "# TYPE %s_commands_total counter\n", namespace)
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s_commands_total{command=%q} %d\n", namespace, name, stats[name].Calls)
+	}
+	fmt.Fprintf(&b, "# HELP %s_commands_duration_microseconds_total Cumulative execution time per command.\n", namespace)
+	fmt.Fprintf(&b, "# TYPE %s_commands_duration_microseconds_total counter\n", namespace)
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s_commands_duration_microseconds_total{command=%q} %d\n", namespace, name, stats[name].Usec)
+	}
+
+	writeMetric(&b, "connected_clients", "gauge", "Number of client connections.", c.ConnectedClients())
+	writeMetric(&b, "keyspace_hits_total", "counter", "Number of successful key lookups.", c.KeyspaceHits())
+	writeMetric(&b, "keyspace_misses_total", "counter", "Number of failed key lookups.", c.KeyspaceMisses())
+	writeMetric(&b, "expired_keys_total", "counter", "Number of keys removed on expiration.", c.ExpiredKeys())
+	writeMetric(&b, "evicted_keys_total", "counter", "Number of keys evicted due to the maxmemory limit.", c.EvictedKeys())
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeMetric(b *strings.Builder, name, kind, help string, value int64) {
+	fmt.Fprintf(b, "# HELP %s_%s %s\n", namespace, name, help)
+	fmt.Fprintf(b, "# TYPE %s_%s %s\n", namespace, name, kind)
+	fmt.Fprintf(b, "%s_%s %d\n", namespace, name, value)
+}
+
+// Handler serves the collector metrics in the Prometheus text format
+func (c *Collector) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := c.WritePrometheus(w); err != nil {
+			logger.Warnf("Error writing metrics: %s", err)
+		}
+	})
+}
+
+// Serve exposes the collector metrics over HTTP at /metrics until ctx is cancelled
+func (c *Collector) Serve(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", c.Handler())
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		if err := srv.Close(); err != nil {
+			logger.Warnf("Error closing metrics listener: %s", err)
+		}
+	}()
+
+	logger.Infof("Metrics are served on: %s/metrics", addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+var std atomic.Pointer[Collector]
+
+func init() {
+	std.Store(NewCollector())
+}
+
+// Default returns the process-wide collector
+func Default() *Collector {
+	return std.Load()
+}
+
+// SetDefault replaces the process-wide collector
+func SetDefault(c *Collector) {
+	std.Store(c)
+}
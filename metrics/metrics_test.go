@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCollectorConcurrentUpdates(t *testing.T) {
+	c := NewCollector()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.CommandProcessed("GET", 2*time.Microsecond)
+				c.KeyspaceHit()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := c.CommandsProcessed(); got != 8000 {
+		t.Errorf("expected 8000 commands, got %d", got)
+	}
+	stat := c.CommandStats()["get"]
+	if stat.Calls != 8000 || stat.Usec != 16000 {
+		t.Errorf("expected 8000 GET calls taking 16000us, got %+v", stat)
+	}
+	if got := stat.UsecPerCall(); got != 2 {
+		t.Errorf("expected 2us per call, got %f", got)
+	}
+	if got := c.KeyspaceHits(); got != 8000 {
+		t.Errorf("expected 8000 hits, got %d", got)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	c := NewCollector()
+	c.CommandProcessed("SET", 5*time.Microsecond)
+	c.CommandProcessed("GET", time.Microsecond)
+	c.CommandProcessed("GET", 2*time.Microsecond)
+	c.ClientConnected()
+	c.KeyspaceMiss()
+	c.KeyExpired()
+
+	srv := httptest.NewServer(c.Handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("failed to scrape metrics: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, _ := io.ReadAll(resp.Body)
+
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("expected text/plain content type, got %q", ct)
+	}
+	for _, line := range []string{
+		"# TYPE goradieschen_commands_processed_total counter",
+		"goradieschen_commands_processed_total 3",
+		`goradieschen_commands_total{command="get"} 2`,
+		`goradieschen_commands_total{command="set"} 1`,
+		`goradieschen_commands_duration_microseconds_total{command="get"} 3`,
+		"# TYPE goradieschen_connected_clients gauge",
+		"goradieschen_connected_clients 1",
+		"goradieschen_keyspace_hits_total 0",
+		"goradieschen_keyspace_misses_total 1",
+		"goradieschen_expired_keys_total 1",
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("expected metrics to contain %q, got:\n%s", line, body)
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	c := NewCollector()
+	c.CommandProcessed("GET", time.Microsecond)
+	c.KeyspaceHit()
+	c.KeyspaceMiss()
+	c.KeyExpired()
+	c.ClientConnected()
+
+	c.Reset()
+
+	if c.CommandsProcessed() != 0 || c.KeyspaceHits() != 0 || c.KeyspaceMisses() != 0 || c.ExpiredKeys() != 0 {
+		t.Errorf("expected counters to be zeroed, got commands=%d hits=%d misses=%d expired=%d",
+			c.CommandsProcessed(), c.KeyspaceHits(), c.KeyspaceMisses(), c.ExpiredKeys())
+	}
+	if len(c.CommandStats()) != 0 {
+		t.Errorf("expected command stats to be cleared, got %v", c.CommandStats())
+	}
+	if got := c.ConnectedClients(); got != 1 {
+		t.Errorf("expected connected clients gauge to be kept, got %d", got)
+	}
+}
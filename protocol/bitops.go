@@ -0,0 +1,49 @@
+package protocol
+
+// bitOp applies the bitwise AND, OR or XOR operation across the values, padding
+// the shorter ones with zero bytes, or NOT to a single value
+func bitOp(op string, values []string) string {
+	size := 0
+	for _, val := range values {
+		size = max(size, len(val))
+	}
+	result := make([]byte, size)
+	if op == "NOT" {
+		for i := range result {
+			result[i] = ^values[0][i]
+		}
+		return string(result)
+	}
+	for i := range result {
+		var acc byte
+		for n, val := range values {
+			var b byte
+			if i < len(val) {
+				b = val[i]
+			}
+			switch {
+			case n == 0:
+				acc = b
+			case op == "AND":
+				acc &= b
+			case op == "OR":
+				acc |= b
+			case op == "XOR":
+				acc ^= b
+			}
+		}
+		result[i] = acc
+	}
+	return string(result)
+}
+
+// bitPos returns the position of the first bit set to bit between the start
+// and end bit offsets of val, both included, or -1 if there is none
+func bitPos(val string, bit byte, start, end int64) int64 {
+	for pos := start; pos <= end; pos++ {
+		if val[pos/8]>>(7-pos%8)&1 == bit {
+			return pos
+		}
+	}
+	return -1
+}
@@ -0,0 +1,38 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// clientFlags renders the flags of the session the way CLIENT INFO does, "N" meaning no flags
+func (s *Session) clientFlags() string {
+	flags := ""
+	if s.NoEvict {
+		flags += "e"
+	}
+	if s.NoTouch {
+		flags += "T"
+	}
+	if s.multi {
+		flags += "x"
+	}
+	if flags == "" {
+		return "N"
+	}
+	return flags
+}
+
+// clientInfo renders the line describing the session in CLIENT INFO
+func (s *Session) clientInfo() string {
+	var addr, laddr string
+	if conn, ok := s.conn.(net.Conn); ok {
+		addr, laddr = conn.RemoteAddr().String(), conn.LocalAddr().String()
+	}
+	now := time.Now()
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d flags=%s db=%d sub=%d psub=0 tot-cmds=%d cmd=%s\n",
+		s.id, addr, laddr, s.Name,
+		int64(now.Sub(s.createdAt).Seconds()), int64(now.Sub(s.lastInteraction).Seconds()),
+		s.clientFlags(), s.DB, len(s.Subscriptions), s.commands, s.lastCommand)
+}
@@ -0,0 +1,19 @@
+package protocol
+
+import (
+	"strings"
+)
+
+// nodeID identifies the node to cluster-aware clients, it's stable for the lifetime of the process
+var nodeID = newRunID()
+
+// clusterInfo renders the reply of CLUSTER INFO for a node with cluster support disabled
+func clusterInfo() string {
+	var b strings.Builder
+	b.WriteString("cluster_enabled:0\r\n")
+	b.WriteString("cluster_state:ok\r\n")
+	b.WriteString("cluster_slots_assigned:0\r\n")
+	b.WriteString("cluster_known_nodes:1\r\n")
+	b.WriteString("cluster_size:0\r\n")
+	return b.String()
+}
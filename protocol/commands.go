@@ -0,0 +1,1061 @@
+package protocol
+
+import (
+	"github.com/pilosus/goradieschen/acl"
+	"github.com/pilosus/goradieschen/metrics"
+	"github.com/pilosus/goradieschen/store"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	for _, cmd := range []Command{
+		{"SET", -3, []string{"write", "denyoom"}, 1, 1, 1, setCommand},
+		{"SETEX", 4, []string{"write", "denyoom"}, 1, 1, 1, setexCommand},
+		{"PSETEX", 4, []string{"write", "denyoom"}, 1, 1, 1, psetexCommand},
+		{"GET", 2, []string{"readonly"}, 1, 1, 1, getCommand},
+		{"MSET", -3, []string{"write", "denyoom"}, 1, -1, 2, msetCommand},
+		{"MSETNX", -3, []string{"write", "denyoom"}, 1, -1, 2, msetnxCommand},
+		{"INCR", 2, []string{"write", "denyoom", "fast"}, 1, 1, 1, incrCommand},
+		{"DEL", -2, []string{"write"}, 1, -1, 1, delCommand},
+		{"UNLINK", -2, []string{"write", "fast"}, 1, -1, 1, delCommand},
+		{"KEYS", 2, []string{"readonly"}, 0, 0, 0, keysCommand},
+		{"EXPIRE", 3, []string{"write"}, 1, 1, 1, expireCommand},
+		{"TTL", 2, []string{"readonly"}, 1, 1, 1, ttlCommand},
+		{"PTTL", 2, []string{"readonly"}, 1, 1, 1, pttlCommand},
+		{"FLUSHALL", 1, []string{"write"}, 0, 0, 0, flushallCommand},
+		{"PING", -1, []string{"stale", "fast"}, 0, 0, 0, pingCommand},
+		{"COMMAND", -1, []string{"readonly"}, 0, 0, 0, commandCommand},
+		{"SYNC", 1, []string{"admin", "no-multi"}, 0, 0, 0, syncCommand},
+		{"REPLICAOF", 3, []string{"admin"}, 0, 0, 0, replicaofCommand},
+		{"SLAVEOF", 3, []string{"admin"}, 0, 0, 0, replicaofCommand},
+		{"INFO", -1, []string{"stale"}, 0, 0, 0, infoCommand},
+		{"RESET", 1, []string{"no-auth", "fast", "stale"}, 0, 0, 0, resetCommand},
+		{"QUIT", -1, []string{"no-auth", "fast", "stale"}, 0, 0, 0, quitCommand},
+		{"CONFIG", -2, []string{"admin"}, 0, 0, 0, configCommand},
+		{"OBJECT", -2, []string{"readonly"}, 2, 2, 1, objectCommand},
+		{"LCS", -3, []string{"readonly"}, 1, 2, 1, lcsCommand},
+		{"GETRANGE", 4, []string{"readonly"}, 1, 1, 1, getrangeCommand},
+		{"SUBSTR", 4, []string{"readonly"}, 1, 1, 1, getrangeCommand},
+		{"SETRANGE", 4, []string{"write", "denyoom"}, 1, 1, 1, setrangeCommand},
+		{"STRLEN", 2, []string{"readonly", "fast"}, 1, 1, 1, strlenCommand},
+		{"APPEND", 3, []string{"write", "denyoom", "fast"}, 1, 1, 1, appendCommand},
+		{"BITOP", -4, []string{"write", "denyoom"}, 2, -1, 1, bitopCommand},
+		{"BITPOS", -3, []string{"readonly"}, 1, 1, 1, bitposCommand},
+		{"PFADD", -2, []string{"write", "denyoom", "fast"}, 1, 1, 1, pfaddCommand},
+		{"PFCOUNT", -2, []string{"readonly"}, 1, -1, 1, pfcountCommand},
+		{"PFMERGE", -2, []string{"write", "denyoom"}, 1, -1, 1, pfmergeCommand},
+		{"DEBUG", -2, []string{"admin"}, 0, 0, 0, debugCommand},
+		{"LOLWUT", -1, []string{"readonly", "fast"}, 0, 0, 0, lolwutCommand},
+		{"MEMORY", -2, []string{"readonly"}, 2, 2, 1, memoryCommand},
+		{"CLIENT", -2, []string{"admin", "stale"}, 0, 0, 0, clientCommand},
+		{"DBSIZE", 1, []string{"readonly", "fast"}, 0, 0, 0, dbsizeCommand},
+		{"FAILOVER", -1, []string{"admin", "stale"}, 0, 0, 0, failoverCommand},
+		{"HELLO", -1, []string{"no-auth", "fast", "stale"}, 0, 0, 0, helloCommand},
+		{"AUTH", -2, []string{"no-auth", "fast", "stale"}, 0, 0, 0, authCommand},
+		{"ACL", -2, []string{"admin", "stale"}, 0, 0, 0, aclCommand},
+		{"CLUSTER", -2, []string{"stale"}, 0, 0, 0, clusterCommand},
+		{"MULTI", 1, []string{"fast", "stale"}, 0, 0, 0, multiCommand},
+		{"EXEC", 1, []string{"stale"}, 0, 0, 0, execCommand},
+		{"DISCARD", 1, []string{"fast", "stale"}, 0, 0, 0, discardCommand},
+	} {
+		Register(cmd)
+	}
+}
+
+func setCommand(s *Session, args []string) string {
+	key, value := args[0], args[1]
+	var nx, xx, get, keepTTL bool
+	var expiresAt time.Time
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "NX" && !xx:
+			nx = true
+		case opt == "XX" && !nx:
+			xx = true
+		case opt == "GET":
+			get = true
+		case opt == "KEEPTTL" && expiresAt.IsZero():
+			keepTTL = true
+		case (opt == "EX" || opt == "PX" || opt == "EXAT" || opt == "PXAT") && !keepTTL && expiresAt.IsZero() && i+1 < len(args):
+			unit := time.Second
+			if opt == "PX" || opt == "PXAT" {
+				unit = time.Millisecond
+			}
+			d, errReply := expireDuration("set", args[i+1], unit)
+			if errReply != "" {
+				return errReply
+			}
+			if opt == "EX" || opt == "PX" {
+				expiresAt = time.Now().Add(d)
+			} else {
+				expiresAt = time.Unix(0, 0).Add(d)
+			}
+			i++
+		default:
+			return EncodeError(GenericErrorPrefix + " syntax error")
+		}
+	}
+
+	var old string
+	var exists bool
+	if nx || xx || get {
+		old, exists = s.lookupRead(key)
+	}
+	// GET replies with the old value whether the key is set or not
+	reply := EncodeSimpleString(ReturnOK)
+	if get {
+		reply = EncodeNullBulkString()
+		if exists {
+			reply = EncodeBulkString(&old)
+		}
+	}
+	if (nx && exists) || (xx && !exists) {
+		if get {
+			return reply
+		}
+		return EncodeNullBulkString()
+	}
+
+	if keepTTL {
+		s.store.Set(key, value)
+	} else {
+		s.setKey(key, value)
+	}
+	if !expiresAt.IsZero() {
+		s.ttl.SetTTL(key, expiresAt)
+	}
+	return reply
+}
+
+func setexCommand(s *Session, args []string) string {
+	return s.setWithExpire("setex", args, time.Second)
+}
+
+func psetexCommand(s *Session, args []string) string {
+	return s.setWithExpire("psetex", args, time.Millisecond)
+}
+
+// setWithExpire sets the key to the value and its TTL to the given number of units,
+// args being the key, the TTL and the value
+func (s *Session) setWithExpire(name string, args []string, unit time.Duration) string {
+	d, errReply := expireDuration(name, args[1], unit)
+	if errReply != "" {
+		return errReply
+	}
+	s.setKey(args[0], args[2])
+	s.ttl.SetTTL(args[0], time.Now().Add(d))
+	return EncodeSimpleString(ReturnOK)
+}
+
+// expireDuration parses a positive expire time given in the unit,
+// returning the error reply of the command if it's invalid
+func expireDuration(name, arg string, unit time.Duration) (time.Duration, string) {
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, EncodeError(GenericErrorPrefix + " value is not an integer or out of range")
+	}
+	if n <= 0 || n > math.MaxInt64/int64(unit) {
+		return 0, EncodeError(GenericErrorPrefix + " invalid expire time in '" + name + "' command")
+	}
+	return time.Duration(n) * unit, ""
+}
+
+func msetCommand(s *Session, args []string) string {
+	if len(args)%2 != 0 {
+		return EncodeError(GenericErrorPrefix + " usage: MSET key value [key value ...]")
+	}
+	// Like in setKey, the TTLs are dropped before the keys are set
+	for i := 0; i < len(args); i += 2 {
+		s.ttl.Remove(args[i])
+	}
+	s.store.SetMany(args)
+	return EncodeSimpleString(ReturnOK)
+}
+
+func msetnxCommand(s *Session, args []string) string {
+	if len(args)%2 != 0 {
+		return EncodeError(GenericErrorPrefix + " usage: MSETNX key value [key value ...]")
+	}
+	if !s.store.SetManyNX(args) {
+		return EncodeInteger(0)
+	}
+	return EncodeInteger(1)
+}
+
+func getCommand(s *Session, args []string) string {
+	val, ok := s.lookupRead(args[0])
+	if !ok {
+		return EncodeNullBulkString()
+	}
+	return EncodeBulkString(&val)
+}
+
+func incrCommand(s *Session, args []string) string {
+	// A missing key counts as 0, the TTL of an existing key is kept
+	var n int64
+	if val, ok := s.store.Get(args[0]); ok {
+		var err error
+		if n, err = strconv.ParseInt(val, 10, 64); err != nil || strconv.FormatInt(n, 10) != val {
+			return EncodeError(GenericErrorPrefix + " value is not an integer or out of range")
+		}
+	}
+	if n == math.MaxInt64 {
+		return EncodeError(GenericErrorPrefix + " increment or decrement would overflow")
+	}
+	n++
+	s.store.Set(args[0], strconv.FormatInt(n, 10))
+	return EncodeInteger(n)
+}
+
+// delCommand serves both DEL and UNLINK, values are reclaimed by the garbage collector either way
+func delCommand(s *Session, args []string) string {
+	return EncodeInteger(int64(s.deleteKeys(args)))
+}
+
+func keysCommand(s *Session, args []string) string {
+	val, ok, err := s.store.Match(s.ctx, args[0])
+	if err != nil {
+		return EncodeError(GenericErrorPrefix + " KEYS aborted: " + err.Error())
+	}
+	if !ok {
+		return EncodeNullBulkString()
+	}
+	return EncodeArray(val)
+}
+
+func expireCommand(s *Session, args []string) string {
+	seconds, err := strconv.Atoi(args[1])
+	if err != nil || seconds < 0 {
+		return EncodeError(GenericErrorPrefix + " invalid seconds value: " + args[1])
+	}
+	_, ok := s.store.Get(args[0])
+	// If the key does not exist, no need to set TTL
+	if !ok {
+		return EncodeInteger(0)
+	}
+	expiresAt := time.Now().Add(time.Duration(seconds) * time.Second)
+	s.ttl.SetTTL(args[0], expiresAt)
+	return EncodeInteger(1)
+}
+
+func ttlCommand(s *Session, args []string) string {
+	return s.ttlReply(args[0], false)
+}
+
+func pttlCommand(s *Session, args []string) string {
+	return s.ttlReply(args[0], true)
+}
+
+// ttlReply returns the remaining time to live of the key in seconds or milliseconds
+func (s *Session) ttlReply(key string, millis bool) string {
+	_, ok := s.lookupRead(key)
+	if !ok {
+		return EncodeInteger(-2) // Key does not exist
+	}
+	expiresAt, ok := s.ttl.GetTTL(key)
+	if !ok {
+		return EncodeInteger(-1) // Key exists but has no TTL set
+	}
+	remaining := max(time.Until(expiresAt), 0).Milliseconds()
+	if millis {
+		return EncodeInteger(remaining)
+	}
+	// Like in Redis, round to the nearest second rather than truncate,
+	// so that a key with 1.9s left reports 2 and not 1
+	return EncodeInteger((remaining + 500) / 1000)
+}
+
+func dbsizeCommand(s *Session, args []string) string {
+	return EncodeInteger(int64(s.store.Len()))
+}
+
+func flushallCommand(s *Session, args []string) string {
+	s.flushAll()
+	return EncodeSimpleString(ReturnOK)
+}
+
+func pingCommand(s *Session, args []string) string {
+	switch len(args) {
+	case 0:
+		return EncodeSimpleString("PONG")
+	case 1:
+		return EncodeBulkString(&args[0])
+	default:
+		return EncodeError(GenericErrorPrefix + " wrong number of arguments for 'ping' command")
+	}
+}
+
+func resetCommand(s *Session, args []string) string {
+	// The connection is brought back to the state of a newly connected client
+	s.discardTransaction()
+	s.DB = 0
+	s.Protocol = 2
+	s.Name = ""
+	s.NoEvict, s.NoTouch = false, false
+	s.User = acl.DefaultUser
+	s.Authenticated = s.users.NoPass(acl.DefaultUser)
+	clear(s.Subscriptions)
+	return EncodeSimpleString("RESET")
+}
+
+func multiCommand(s *Session, args []string) string {
+	if s.multi {
+		return EncodeError(GenericErrorPrefix + " MULTI calls can not be nested")
+	}
+	s.multi = true
+	return EncodeSimpleString(ReturnOK)
+}
+
+func execCommand(s *Session, args []string) string {
+	if !s.multi {
+		return EncodeError(GenericErrorPrefix + " EXEC without MULTI")
+	}
+	queue, failed := s.Queue, s.multiFailed
+	s.discardTransaction()
+	if failed {
+		return EncodeError(ExecAbortErrorPrefix + " Transaction discarded because of previous errors.")
+	}
+	return s.execQueue(queue)
+}
+
+func discardCommand(s *Session, args []string) string {
+	if !s.multi {
+		return EncodeError(GenericErrorPrefix + " DISCARD without MULTI")
+	}
+	s.discardTransaction()
+	return EncodeSimpleString(ReturnOK)
+}
+
+func quitCommand(s *Session, args []string) string {
+	// The reply is written before the connection is closed
+	s.closing = true
+	return EncodeSimpleString(ReturnOK)
+}
+
+func commandCommand(s *Session, args []string) string {
+	if len(args) == 1 && strings.EqualFold(args[0], "HELP") {
+		return helpReply("COMMAND")
+	}
+	if len(args) > 0 && strings.ToUpper(args[0]) == "GETKEYS" {
+		if len(args) < 2 {
+			return EncodeError(GenericErrorPrefix + " usage: COMMAND GETKEYS command [arg ...]")
+		}
+		keys, err := getKeys(args[1:])
+		if err != nil {
+			return EncodeError(GenericErrorPrefix + " " + err.Error())
+		}
+		return EncodeArray(keys)
+	}
+	if len(args) > 0 && strings.EqualFold(args[0], "LIST") {
+		return commandList(args[1:])
+	}
+	if len(args) != 0 {
+		return EncodeError(GenericErrorPrefix + " usage: COMMAND [GETKEYS command [arg ...] | LIST [FILTERBY MODULE name | ACLCAT category | PATTERN pattern]]")
+	}
+	cmds := commands()
+	result := make([]interface{}, 0, len(cmds))
+	for _, cmd := range cmds {
+		result = append(result, []interface{}{cmd.Name, cmd.Arity, cmd.Flags, cmd.FirstKey, cmd.LastKey, cmd.Step})
+	}
+	return EncodeArrayMixed(result)
+}
+
+func infoCommand(s *Session, args []string) string {
+	if len(args) > 1 {
+		return EncodeError(GenericErrorPrefix + " usage: INFO [section]")
+	}
+	section := ""
+	if len(args) == 1 {
+		section = args[0]
+	}
+	result := info(section, s.store, s.ttl, s.repl)
+	return EncodeBulkString(&result)
+}
+
+func configCommand(s *Session, args []string) string {
+	switch strings.ToUpper(args[0]) {
+	case "HELP":
+		return helpReply("CONFIG")
+	case "RESETSTAT":
+		if len(args) != 1 {
+			return EncodeError(GenericErrorPrefix + " usage: CONFIG RESETSTAT")
+		}
+		metrics.Default().Reset()
+		return EncodeSimpleString(ReturnOK)
+	default:
+		return EncodeError(GenericErrorPrefix + " unknown subcommand '" + args[0] + "'")
+	}
+}
+
+func objectCommand(s *Session, args []string) string {
+	switch strings.ToUpper(args[0]) {
+	case "HELP":
+		return helpReply("OBJECT")
+	case "REFCOUNT":
+		if len(args) != 2 {
+			return EncodeError(GenericErrorPrefix + " usage: OBJECT REFCOUNT key")
+		}
+		// Inspecting a key doesn't count as an access
+		val, ok := s.store.Peek(args[1])
+		if !ok {
+			return EncodeError(GenericErrorPrefix + " no such key")
+		}
+		if !s.store.IsRaw(args[1]) && isSharedInteger(val) {
+			return EncodeInteger(sharedRefCount)
+		}
+		return EncodeInteger(1)
+	case "ENCODING":
+		if len(args) != 2 {
+			return EncodeError(GenericErrorPrefix + " usage: OBJECT ENCODING key")
+		}
+		val, ok := s.store.Peek(args[1])
+		if !ok {
+			return EncodeNullBulkString()
+		}
+		encoding := stringEncoding(val, s.store.IsRaw(args[1]))
+		return EncodeBulkString(&encoding)
+	case "IDLETIME":
+		if len(args) != 2 {
+			return EncodeError(GenericErrorPrefix + " usage: OBJECT IDLETIME key")
+		}
+		accessed, ok := s.store.AccessedAt(args[1])
+		if !ok {
+			return EncodeError(GenericErrorPrefix + " no such key")
+		}
+		return EncodeInteger(int64(time.Since(accessed).Seconds()))
+	default:
+		return EncodeError(GenericErrorPrefix + " unknown subcommand '" + args[0] + "'")
+	}
+}
+
+func lcsCommand(s *Session, args []string) string {
+	var getLen, getIdx, withMatchLen bool
+	minMatchLen := 0
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "LEN":
+			getLen = true
+		case "IDX":
+			getIdx = true
+		case "WITHMATCHLEN":
+			withMatchLen = true
+		case "MINMATCHLEN":
+			if i+1 >= len(args) {
+				return EncodeError(GenericErrorPrefix + " syntax error")
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return EncodeError(GenericErrorPrefix + " value is not an integer or out of range")
+			}
+			minMatchLen = max(n, 0)
+			i++
+		default:
+			return EncodeError(GenericErrorPrefix + " syntax error")
+		}
+	}
+	if getLen && getIdx {
+		return EncodeError(GenericErrorPrefix + " If you want both the length and indexes, please just use IDX.")
+	}
+	// Missing keys compare as empty strings
+	a, _ := s.lookupRead(args[0])
+	b, _ := s.lookupRead(args[1])
+	result, matches := lcs(a, b)
+	if getLen {
+		return EncodeInteger(int64(len(result)))
+	}
+	if !getIdx {
+		return EncodeBulkString(&result)
+	}
+	ranges := []interface{}{}
+	for _, m := range matches {
+		if m.Len() < minMatchLen {
+			continue
+		}
+		match := []interface{}{[]interface{}{m.aStart, m.aEnd}, []interface{}{m.bStart, m.bEnd}}
+		if withMatchLen {
+			match = append(match, m.Len())
+		}
+		ranges = append(ranges, match)
+	}
+	return EncodeArrayMixed([]interface{}{"matches", ranges, "len", len(result)})
+}
+
+func getrangeCommand(s *Session, args []string) string {
+	start, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return EncodeError(GenericErrorPrefix + " value is not an integer or out of range")
+	}
+	end, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return EncodeError(GenericErrorPrefix + " value is not an integer or out of range")
+	}
+	val, _ := s.lookupRead(args[0])
+	result := getRange(val, start, end)
+	return EncodeBulkString(&result)
+}
+
+func strlenCommand(s *Session, args []string) string {
+	// Values are byte strings, so the length is in bytes whatever the encoding
+	val, _ := s.lookupRead(args[0])
+	return EncodeInteger(int64(len(val)))
+}
+
+func appendCommand(s *Session, args []string) string {
+	// A missing key is created, the TTL of an existing key is kept
+	val, _ := s.store.Get(args[0])
+	if int64(len(val)+len(args[1])) > ProtoMaxBulkLen() {
+		return EncodeError(GenericErrorPrefix + " string exceeds maximum allowed size (proto-max-bulk-len)")
+	}
+	val += args[1]
+	s.store.SetRaw(args[0], val)
+	return EncodeInteger(int64(len(val)))
+}
+
+func setrangeCommand(s *Session, args []string) string {
+	offset, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return EncodeError(GenericErrorPrefix + " value is not an integer or out of range")
+	}
+	if offset < 0 {
+		return EncodeError(GenericErrorPrefix + " offset is out of range")
+	}
+	val, ok := s.store.Get(args[0])
+	// An empty value doesn't modify the string, nor does it create a missing key
+	if args[2] == "" {
+		return EncodeInteger(int64(len(val)))
+	}
+	if offset+int64(len(args[2])) > ProtoMaxBulkLen() {
+		return EncodeError(GenericErrorPrefix + " string exceeds maximum allowed size (proto-max-bulk-len)")
+	}
+	if !ok {
+		val = ""
+	}
+	result := setRange(val, offset, args[2])
+	s.store.SetRaw(args[0], result)
+	return EncodeInteger(int64(len(result)))
+}
+
+func bitopCommand(s *Session, args []string) string {
+	op := strings.ToUpper(args[0])
+	switch op {
+	case "AND", "OR", "XOR":
+	case "NOT":
+		if len(args) != 3 {
+			return EncodeError(GenericErrorPrefix + " BITOP NOT must be called with a single source key.")
+		}
+	default:
+		return EncodeError(GenericErrorPrefix + " syntax error")
+	}
+	// Missing keys are treated as empty strings
+	values := make([]string, 0, len(args)-2)
+	for _, key := range args[2:] {
+		val, _ := s.lookupRead(key)
+		values = append(values, val)
+	}
+	result := bitOp(op, values)
+	if result == "" {
+		s.deleteKey(args[1])
+		return EncodeInteger(0)
+	}
+	s.setKey(args[1], result)
+	return EncodeInteger(int64(len(result)))
+}
+
+func bitposCommand(s *Session, args []string) string {
+	if len(args) > 5 {
+		return EncodeError(GenericErrorPrefix + " usage: BITPOS key bit [start [end [BYTE|BIT]]]")
+	}
+	var bit byte
+	switch args[1] {
+	case "0":
+	case "1":
+		bit = 1
+	default:
+		return EncodeError(GenericErrorPrefix + " The bit argument must be 1 or 0.")
+	}
+	var start, end int64 = 0, -1
+	var err error
+	if len(args) > 2 {
+		if start, err = strconv.ParseInt(args[2], 10, 64); err != nil {
+			return EncodeError(GenericErrorPrefix + " value is not an integer or out of range")
+		}
+	}
+	endGiven := len(args) > 3
+	if endGiven {
+		if end, err = strconv.ParseInt(args[3], 10, 64); err != nil {
+			return EncodeError(GenericErrorPrefix + " value is not an integer or out of range")
+		}
+	}
+	bitMode := false
+	if len(args) > 4 {
+		switch strings.ToUpper(args[4]) {
+		case "BYTE":
+		case "BIT":
+			bitMode = true
+		default:
+			return EncodeError(GenericErrorPrefix + " syntax error")
+		}
+	}
+	val, ok := s.lookupRead(args[0])
+	if !ok {
+		// A missing key is an endless run of clear bits
+		if bit == 1 {
+			return EncodeInteger(-1)
+		}
+		return EncodeInteger(0)
+	}
+	size := int64(len(val))
+	if bitMode {
+		size *= 8
+	}
+	// Offsets are resolved the same way as in GETRANGE
+	if start < 0 {
+		start += size
+	}
+	if end < 0 {
+		end += size
+	}
+	start = max(start, 0)
+	end = min(max(end, 0), size-1)
+	if start > end {
+		return EncodeInteger(-1)
+	}
+	if !bitMode {
+		start, end = start*8, end*8+7
+	}
+	pos := bitPos(val, bit, start, end)
+	// Without an explicit end, the string is considered padded with clear bits on the right
+	if pos == -1 && bit == 0 && !endGiven {
+		return EncodeInteger(end + 1)
+	}
+	return EncodeInteger(pos)
+}
+
+// invalidHLLError is returned for a key that holds a string other than a HyperLogLog
+func invalidHLLError() string {
+	return EncodeError(WrongTypeErrorPrefix + " Key is not a valid HyperLogLog string value.")
+}
+
+func pfaddCommand(s *Session, args []string) string {
+	val, ok := s.store.Get(args[0])
+	h := newHLL()
+	if ok {
+		if h, ok = parseHLL(val); !ok {
+			return invalidHLLError()
+		}
+	}
+	// Creating the key counts as a change even without elements
+	changed := !ok
+	for _, element := range args[1:] {
+		if h.add(element) {
+			changed = true
+		}
+	}
+	if !changed {
+		return EncodeInteger(0)
+	}
+	// Like APPEND, the TTL of an existing key is kept
+	s.store.SetRaw(args[0], string(h))
+	return EncodeInteger(1)
+}
+
+func pfcountCommand(s *Session, args []string) string {
+	// Multiple keys are counted as their union, missing keys are empty HyperLogLogs
+	union := newHLL()
+	for _, key := range args {
+		val, ok := s.lookupRead(key)
+		if !ok {
+			continue
+		}
+		h, ok := parseHLL(val)
+		if !ok {
+			return invalidHLLError()
+		}
+		if len(args) == 1 {
+			return EncodeInteger(h.count())
+		}
+		union.merge(h)
+	}
+	return EncodeInteger(union.count())
+}
+
+func pfmergeCommand(s *Session, args []string) string {
+	// The destination is part of the union if it exists
+	union := newHLL()
+	for _, key := range args {
+		val, ok := s.store.Get(key)
+		if !ok {
+			continue
+		}
+		h, ok := parseHLL(val)
+		if !ok {
+			return invalidHLLError()
+		}
+		union.merge(h)
+	}
+	s.store.SetRaw(args[0], string(union))
+	return EncodeSimpleString(ReturnOK)
+}
+
+func debugCommand(s *Session, args []string) string {
+	switch strings.ToUpper(args[0]) {
+	case "HELP":
+		return helpReply("DEBUG")
+	case "OBJECT":
+		if len(args) != 2 {
+			return EncodeError(GenericErrorPrefix + " usage: DEBUG OBJECT key")
+		}
+		val, ok := s.store.Peek(args[1])
+		if !ok {
+			return EncodeError(GenericErrorPrefix + " no such key")
+		}
+		accessed, _ := s.store.AccessedAt(args[1])
+		return EncodeSimpleString(debugObject(val, s.store.IsRaw(args[1]), time.Since(accessed)))
+	case "STRINGMATCH-LEN":
+		if len(args) != 3 {
+			return EncodeError(GenericErrorPrefix + " usage: DEBUG STRINGMATCH-LEN pattern string")
+		}
+		if store.StringMatch(args[1], args[2], false) {
+			return EncodeInteger(1)
+		}
+		return EncodeInteger(0)
+	case "SET-ACTIVE-EXPIRE":
+		if len(args) != 2 || (args[1] != "0" && args[1] != "1") {
+			return EncodeError(GenericErrorPrefix + " usage: DEBUG SET-ACTIVE-EXPIRE 0|1")
+		}
+		s.ttl.SetActiveExpire(args[1] == "1")
+		return EncodeSimpleString(ReturnOK)
+	case "SLEEP":
+		if len(args) != 2 {
+			return EncodeError(GenericErrorPrefix + " usage: DEBUG SLEEP seconds")
+		}
+		seconds, err := strconv.ParseFloat(args[1], 64)
+		if err != nil || math.IsNaN(seconds) || seconds < 0 || seconds > math.MaxInt64/float64(time.Second) {
+			return EncodeError(GenericErrorPrefix + " value is not a valid float")
+		}
+		// Unlike in Redis, only this connection sleeps: every connection is served
+		// by its own goroutine and no lock is held in the meantime
+		timer := time.NewTimer(time.Duration(seconds * float64(time.Second)))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return EncodeSimpleString(ReturnOK)
+		case <-s.ctx.Done():
+			return EncodeError(GenericErrorPrefix + " DEBUG SLEEP aborted: " + s.ctx.Err().Error())
+		}
+	default:
+		return EncodeError(GenericErrorPrefix + " unknown subcommand '" + args[0] + "'")
+	}
+}
+
+func lolwutCommand(s *Session, args []string) string {
+	if len(args) != 0 && (len(args) != 2 || !strings.EqualFold(args[0], "VERSION")) {
+		return EncodeError(GenericErrorPrefix + " usage: LOLWUT [VERSION version]")
+	}
+	if len(args) == 2 {
+		if _, err := strconv.Atoi(args[1]); err != nil {
+			return EncodeError(GenericErrorPrefix + " value is not an integer or out of range")
+		}
+	}
+	// There is no art to draw yet, whatever version is asked for
+	result := "goradieschen ver. " + Version + "\n"
+	return EncodeBulkString(&result)
+}
+
+func memoryCommand(s *Session, args []string) string {
+	switch strings.ToUpper(args[0]) {
+	case "HELP":
+		return helpReply("MEMORY")
+	case "STATS":
+		if len(args) != 1 {
+			return EncodeError(GenericErrorPrefix + " usage: MEMORY STATS")
+		}
+		return EncodeArrayMixed(memoryStats(s.store, s.repl))
+	case "DOCTOR":
+		if len(args) != 1 {
+			return EncodeError(GenericErrorPrefix + " usage: MEMORY DOCTOR")
+		}
+		result := memoryDoctor(s.store, s.evict)
+		return EncodeBulkString(&result)
+	case "USAGE":
+		if len(args) != 2 && len(args) != 4 {
+			return EncodeError(GenericErrorPrefix + " usage: MEMORY USAGE key [SAMPLES count]")
+		}
+		// Only strings are stored, so there are no elements to sample
+		if len(args) == 4 {
+			if !strings.EqualFold(args[2], "SAMPLES") {
+				return EncodeError(GenericErrorPrefix + " syntax error")
+			}
+			if n, err := strconv.Atoi(args[3]); err != nil || n < 0 {
+				return EncodeError(GenericErrorPrefix + " value is not an integer or out of range")
+			}
+		}
+		usage, ok := s.store.MemoryUsage(args[1])
+		if !ok {
+			return EncodeNullBulkString()
+		}
+		return EncodeInteger(usage)
+	default:
+		return EncodeError(GenericErrorPrefix + " unknown subcommand '" + args[0] + "'")
+	}
+}
+
+func clientCommand(s *Session, args []string) string {
+	var flag *bool
+	switch strings.ToUpper(args[0]) {
+	case "HELP":
+		return helpReply("CLIENT")
+	case "INFO":
+		if len(args) != 1 {
+			return EncodeError(GenericErrorPrefix + " usage: CLIENT INFO")
+		}
+		result := s.clientInfo()
+		return EncodeBulkString(&result)
+	case "NO-EVICT":
+		// Only recorded for now, as there is no client eviction yet
+		flag = &s.NoEvict
+	case "NO-TOUCH":
+		flag = &s.NoTouch
+	default:
+		return EncodeError(GenericErrorPrefix + " unknown subcommand '" + args[0] + "'")
+	}
+	if len(args) != 2 {
+		return EncodeError(GenericErrorPrefix + " usage: CLIENT " + strings.ToUpper(args[0]) + " ON|OFF")
+	}
+	switch strings.ToUpper(args[1]) {
+	case "ON":
+		*flag = true
+	case "OFF":
+		*flag = false
+	default:
+		return EncodeError(GenericErrorPrefix + " syntax error")
+	}
+	return EncodeSimpleString(ReturnOK)
+}
+
+func clusterCommand(s *Session, args []string) string {
+	sub := strings.ToUpper(args[0])
+	switch sub {
+	case "HELP":
+		return helpReply("CLUSTER")
+	case "INFO", "SLOTS", "SHARDS", "MYID":
+		if len(args) != 1 {
+			return EncodeError(GenericErrorPrefix + " usage: CLUSTER " + sub)
+		}
+	default:
+		return EncodeError(GenericErrorPrefix + " unknown subcommand '" + args[0] + "'")
+	}
+	// Cluster support is disabled, so the node owns no slots and knows no other nodes
+	switch sub {
+	case "INFO":
+		result := clusterInfo()
+		return EncodeBulkString(&result)
+	case "MYID":
+		return EncodeBulkString(&nodeID)
+	default:
+		return EncodeArray([]string{})
+	}
+}
+
+func failoverCommand(s *Session, args []string) string {
+	// Failovers are never started, so there is none to abort
+	if len(args) == 1 && strings.EqualFold(args[0], "ABORT") {
+		return EncodeSimpleString(ReturnOK)
+	}
+	if s.repl.Info().ConnectedReplicas == 0 {
+		return EncodeError(GenericErrorPrefix + " FAILOVER requires connected replicas.")
+	}
+	return EncodeError(GenericErrorPrefix + " FAILOVER is not supported, promote a replica with REPLICAOF NO ONE instead.")
+}
+
+func authCommand(s *Session, args []string) string {
+	if len(args) > 2 {
+		return EncodeError(GenericErrorPrefix + " syntax error")
+	}
+	// A single argument is the password of the default user
+	name, password := acl.DefaultUser, args[0]
+	if len(args) == 2 {
+		name, password = args[0], args[1]
+	}
+	if !s.users.Authenticate(name, password) {
+		return EncodeError(WrongPassErrorPrefix + " invalid username-password pair or user is disabled.")
+	}
+	s.Authenticated, s.User = true, name
+	return EncodeSimpleString(ReturnOK)
+}
+
+func helloCommand(s *Session, args []string) string {
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			return EncodeError(GenericErrorPrefix + " Protocol version is not an integer or out of range")
+		}
+		// Replies are only encoded with the RESP2 types, so RESP3 can't be switched to
+		if n != 2 {
+			return EncodeError(NoProtoErrorPrefix + " unsupported protocol version")
+		}
+	}
+	var user, password, name string
+	var auth, setName bool
+	for i := 1; i < len(args); i++ {
+		switch {
+		case strings.EqualFold(args[i], "AUTH") && i+2 < len(args):
+			auth, user, password = true, args[i+1], args[i+2]
+			i += 2
+		case strings.EqualFold(args[i], "SETNAME") && i+1 < len(args):
+			setName, name = true, args[i+1]
+			i++
+		default:
+			return EncodeError(GenericErrorPrefix + " Syntax error in HELLO option '" + args[i] + "'")
+		}
+	}
+	if auth {
+		if !s.users.Authenticate(user, password) {
+			return EncodeError(WrongPassErrorPrefix + " invalid username-password pair or user is disabled.")
+		}
+		s.Authenticated, s.User = true, user
+	}
+	if !s.Authenticated {
+		return EncodeError(NoAuthErrorPrefix + " HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+	}
+	if setName {
+		s.Name = name
+	}
+	return EncodeArrayMixed([]interface{}{
+		"server", "goradieschen",
+		"version", Version,
+		"proto", s.Protocol,
+		"id", s.id,
+		"mode", "standalone",
+		"role", s.repl.Info().Role,
+		"modules", []interface{}{},
+	})
+}
+
+func aclCommand(s *Session, args []string) string {
+	sub := strings.ToUpper(args[0])
+	switch sub {
+	case "HELP":
+		return helpReply("ACL")
+	case "WHOAMI":
+		if len(args) != 1 {
+			return EncodeError(GenericErrorPrefix + " usage: ACL WHOAMI")
+		}
+		return EncodeBulkString(&s.User)
+	case "LIST":
+		if len(args) != 1 {
+			return EncodeError(GenericErrorPrefix + " usage: ACL LIST")
+		}
+		lines := []string{}
+		for _, name := range s.users.Names() {
+			if d, ok := s.users.Describe(name); ok {
+				lines = append(lines, "user "+name+" "+d.Rules())
+			}
+		}
+		return EncodeArray(lines)
+	case "SETUSER":
+		if len(args) < 2 {
+			return EncodeError(GenericErrorPrefix + " usage: ACL SETUSER username [rule [rule ...]]")
+		}
+		if err := s.users.SetUser(args[1], args[2:]); err != nil {
+			return EncodeError(GenericErrorPrefix + " " + err.Error())
+		}
+		return EncodeSimpleString(ReturnOK)
+	case "GETUSER":
+		if len(args) != 2 {
+			return EncodeError(GenericErrorPrefix + " usage: ACL GETUSER username")
+		}
+		d, ok := s.users.Describe(args[1])
+		if !ok {
+			return EncodeNullBulkString()
+		}
+		flags := make([]interface{}, 0, len(d.Flags))
+		for _, flag := range d.Flags {
+			flags = append(flags, flag)
+		}
+		passwords := make([]interface{}, 0, len(d.Passwords))
+		for _, hash := range d.Passwords {
+			passwords = append(passwords, hash)
+		}
+		return EncodeArrayMixed([]interface{}{"flags", flags, "passwords", passwords, "commands", d.Commands, "keys", d.Keys})
+	default:
+		return EncodeError(GenericErrorPrefix + " unknown subcommand '" + args[0] + "'")
+	}
+}
+
+// aclCategoryFlags maps the ACL categories COMMAND LIST filters by to the command flags they are derived from
+var aclCategoryFlags = map[string]string{
+	"read":      "readonly",
+	"write":     "write",
+	"admin":     "admin",
+	"dangerous": "admin",
+	"fast":      "fast",
+}
+
+// inACLCategory reports whether the command belongs to the ACL category, commands that aren't fast are slow
+func inACLCategory(cmd *Command, category string) bool {
+	if category == "slow" {
+		return !hasFlag(cmd.Name, "fast")
+	}
+	flag, ok := aclCategoryFlags[category]
+	return ok && hasFlag(cmd.Name, flag)
+}
+
+// commandList renders the reply of COMMAND LIST, args being the arguments after LIST
+func commandList(args []string) string {
+	if len(args) != 0 && (len(args) != 3 || !strings.EqualFold(args[0], "FILTERBY")) {
+		return EncodeError(GenericErrorPrefix + " syntax error")
+	}
+	var match func(cmd *Command) bool
+	if len(args) == 3 {
+		switch value := args[2]; strings.ToUpper(args[1]) {
+		case "MODULE":
+			// No module is ever loaded
+			match = func(*Command) bool { return false }
+		case "ACLCAT":
+			category := strings.ToLower(strings.TrimPrefix(value, "@"))
+			match = func(cmd *Command) bool { return inACLCategory(cmd, category) }
+		case "PATTERN":
+			match = func(cmd *Command) bool { return store.StringMatch(value, strings.ToLower(cmd.Name), true) }
+		default:
+			return EncodeError(GenericErrorPrefix + " syntax error")
+		}
+	}
+	names := []string{}
+	for _, cmd := range commands() {
+		if match == nil || match(cmd) {
+			names = append(names, strings.ToLower(cmd.Name))
+		}
+	}
+	return EncodeArray(names)
+}
+
+func syncCommand(s *Session, args []string) string {
+	// The connection is closed once the replica is gone
+	s.closing = true
+	remove := s.repl.AddReplica(s.conn, func() string { return fullSync(s.store, s.ttl) })
+	defer remove()
+	// From now on the connection carries the replication stream,
+	// drain whatever the replica sends until it disconnects
+	_, _ = io.Copy(io.Discard, s.reader)
+	return ""
+}
+
+func replicaofCommand(s *Session, args []string) string {
+	if strings.EqualFold(args[0], "NO") && strings.EqualFold(args[1], "ONE") {
+		s.repl.StopReplication()
+		return EncodeSimpleString(ReturnOK)
+	}
+	if _, err := strconv.Atoi(args[1]); err != nil {
+		return EncodeError(GenericErrorPrefix + " invalid port value: " + args[1])
+	}
+	// The primary's stream is applied through a dedicated session
+	link := NewSession(io.Discard, s.store, s.ttl, s.repl, s.evict, s.users)
+	s.repl.ReplicaOf(net.JoinHostPort(args[0], args[1]), link.applyCommand)
+	return EncodeSimpleString(ReturnOK)
+}
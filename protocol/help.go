@@ -0,0 +1,83 @@
+package protocol
+
+// subcommandHelp holds the usage lines of the subcommands of the container commands,
+// listed by their HELP subcommand
+var subcommandHelp = map[string][]string{
+	"ACL": {
+		"GETUSER <username>",
+		"    Get the user's details.",
+		"LIST",
+		"    List all users in ACL format.",
+		"SETUSER <username> <attribute> [<attribute> ...]",
+		"    Create or modify a user with the specified attributes.",
+		"WHOAMI",
+		"    Return the current connection username.",
+	},
+	"CLIENT": {
+		"INFO",
+		"    Return information about the current client connection.",
+		"NO-EVICT (ON|OFF)",
+		"    Protect the current client connection from eviction.",
+		"NO-TOUCH (ON|OFF)",
+		"    Keep the commands of the current client from altering the access time of keys.",
+	},
+	"CLUSTER": {
+		"INFO",
+		"    Return information about the cluster, which is always disabled.",
+		"MYID",
+		"    Return the node id.",
+		"SHARDS",
+		"    Return information about slot range mappings and the nodes they are assigned to.",
+		"SLOTS",
+		"    Return information about slots range mappings.",
+	},
+	"COMMAND": {
+		"(no subcommand)",
+		"    Return details about all commands.",
+		"GETKEYS <full-command>",
+		"    Return the keys from a full command.",
+		"LIST [FILTERBY (MODULE <module-name>|ACLCAT <category>|PATTERN <pattern>)]",
+		"    Return a list of all commands in this server.",
+	},
+	"CONFIG": {
+		"RESETSTAT",
+		"    Reset the statistics reported by the INFO command.",
+	},
+	"DEBUG": {
+		"OBJECT <key>",
+		"    Show low level info about the key and the value associated with it.",
+		"SET-ACTIVE-EXPIRE (0|1)",
+		"    Setting it to 0 disables the expiration of keys in the background.",
+		"SLEEP <seconds>",
+		"    Block the connection for <seconds>, decimals allowed. Other connections keep being served.",
+		"STRINGMATCH-LEN <pattern> <string>",
+		"    Return 1 if the <string> matches the glob-style <pattern>, 0 otherwise.",
+	},
+	"MEMORY": {
+		"DOCTOR",
+		"    Return memory problems reports.",
+		"STATS",
+		"    Return information about the memory usage of the server.",
+		"USAGE <key> [SAMPLES <count>]",
+		"    Return memory in bytes used by <key> and its value.",
+	},
+	"OBJECT": {
+		"ENCODING <key>",
+		"    Return the kind of internal representation used in order to store the value",
+		"    associated with a <key>.",
+		"IDLETIME <key>",
+		"    Return the idle time of the <key>, that is the approximated number of",
+		"    seconds elapsed since the last access to the key.",
+		"REFCOUNT <key>",
+		"    Return the number of references of the value associated with the specified",
+		"    <key>.",
+	},
+}
+
+// helpReply renders the reply of the HELP subcommand of a container command
+func helpReply(name string) string {
+	lines := []string{name + " <subcommand> [<arg> [value] [opt] ...]. Subcommands are:"}
+	lines = append(lines, subcommandHelp[name]...)
+	lines = append(lines, "HELP", "    Print this help.")
+	return EncodeArray(lines)
+}
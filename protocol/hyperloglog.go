@@ -0,0 +1,167 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+)
+
+// HyperLogLogs are stored as string values in the dense representation Redis uses:
+// a 16 byte header followed by 2^14 registers of 6 bits each
+const (
+	hllPrecision     = 14
+	hllRegisters     = 1 << hllPrecision
+	hllRegisterBits  = 6
+	hllRegisterMax   = 1<<hllRegisterBits - 1
+	hllHeaderSize    = 16
+	hllSize          = hllHeaderSize + hllRegisters*hllRegisterBits/8
+	hllMagic         = "HYLL"
+	hllDense         = 0
+	hllPatternBits   = 64 - hllPrecision
+	hllAlphaInfinity = 0.721347520444481703680
+)
+
+// hll is a dense HyperLogLog, the header included
+type hll []byte
+
+// newHLL returns an empty HyperLogLog
+func newHLL() hll {
+	h := make(hll, hllSize)
+	copy(h, hllMagic)
+	h[4] = hllDense
+	// The cached cardinality isn't maintained, the most significant bit marks it as invalid
+	h[15] = 1 << 7
+	return h
+}
+
+// parseHLL returns the HyperLogLog stored in val, reporting whether val is one
+func parseHLL(val string) (hll, bool) {
+	if len(val) != hllSize || val[:4] != hllMagic || val[4] != hllDense {
+		return nil, false
+	}
+	return hll(val), true
+}
+
+// register returns the value of the i-th register. Registers are packed
+// least significant bit first and may span two bytes.
+func (h hll) register(i int) uint8 {
+	regs := h[hllHeaderSize:]
+	b := i * hllRegisterBits / 8
+	fb := uint(i * hllRegisterBits & 7)
+	v := uint(regs[b]) >> fb
+	if b+1 < len(regs) {
+		v |= uint(regs[b+1]) << (8 - fb)
+	}
+	return uint8(v & hllRegisterMax)
+}
+
+// setRegister sets the i-th register to v
+func (h hll) setRegister(i int, v uint8) {
+	regs := h[hllHeaderSize:]
+	b := i * hllRegisterBits / 8
+	fb := uint(i * hllRegisterBits & 7)
+	regs[b] &^= byte(hllRegisterMax << fb)
+	regs[b] |= byte(uint(v) << fb)
+	if b+1 < len(regs) {
+		regs[b+1] &^= byte(hllRegisterMax >> (8 - fb))
+		regs[b+1] |= byte(uint(v) >> (8 - fb))
+	}
+}
+
+// add adds the element, reporting whether a register has changed
+func (h hll) add(element string) bool {
+	hash := murmurHash64A([]byte(element), 0xadc83b19)
+	index := int(hash & (hllRegisters - 1))
+	// The sentinel bit bounds the run of zeros by the number of bits left in the hash
+	hash = hash>>hllPrecision | 1<<hllPatternBits
+	count := uint8(bits.TrailingZeros64(hash) + 1)
+	if h.register(index) >= count {
+		return false
+	}
+	h.setRegister(index, count)
+	return true
+}
+
+// merge sets every register to the maximum of its value in h and other
+func (h hll) merge(other hll) {
+	for i := range hllRegisters {
+		if v := other.register(i); v > h.register(i) {
+			h.setRegister(i, v)
+		}
+	}
+}
+
+// count estimates the cardinality with the estimator by Otmar Ertl that Redis uses,
+// see "New cardinality estimation algorithms for HyperLogLog sketches"
+func (h hll) count() int64 {
+	var histogram [hllPatternBits + 2]int
+	for i := range hllRegisters {
+		histogram[h.register(i)]++
+	}
+	const m = float64(hllRegisters)
+	z := m * hllTau((m-float64(histogram[hllPatternBits+1]))/m)
+	for k := hllPatternBits; k >= 1; k-- {
+		z += float64(histogram[k])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(histogram[0])/m)
+	return int64(math.Round(hllAlphaInfinity * m * m / z))
+}
+
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y, z := 1.0, x
+	for {
+		x *= x
+		prev := z
+		z += x * y
+		y += y
+		if prev == z {
+			return z
+		}
+	}
+}
+
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		prev := z
+		y *= 0.5
+		z -= math.Pow(1-x, 2) * y
+		if prev == z {
+			return z / 3
+		}
+	}
+}
+
+// murmurHash64A is the 64-bit MurmurHash2 variant Redis hashes HyperLogLog elements with
+func murmurHash64A(data []byte, seed uint64) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+	h := seed ^ uint64(len(data))*m
+	for len(data) >= 8 {
+		k := binary.LittleEndian.Uint64(data)
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+		data = data[8:]
+	}
+	if len(data) > 0 {
+		for i := len(data) - 1; i >= 0; i-- {
+			h ^= uint64(data[i]) << (8 * i)
+		}
+		h *= m
+	}
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
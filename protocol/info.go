@@ -0,0 +1,126 @@
+package protocol
+
+import (
+	"fmt"
+	"github.com/pilosus/goradieschen/metrics"
+	"github.com/pilosus/goradieschen/replication"
+	"github.com/pilosus/goradieschen/ttlstore"
+	"net"
+	"os"
+	"strings"
+)
+
+// infoServer renders the server section of the INFO command
+func infoServer() string {
+	var b strings.Builder
+	b.WriteString("# Server\r\n")
+	fmt.Fprintf(&b, "goradieschen_version:%s\r\n", Version)
+	fmt.Fprintf(&b, "process_id:%d\r\n", os.Getpid())
+	fmt.Fprintf(&b, "run_id:%s\r\n", runID)
+	return b.String()
+}
+
+// infoClients renders the clients section of the INFO command
+func infoClients(stats *metrics.Collector) string {
+	var b strings.Builder
+	b.WriteString("# Clients\r\n")
+	fmt.Fprintf(&b, "connected_clients:%d\r\n", stats.ConnectedClients())
+	// The number of connections isn't limited, which is reported as 0
+	fmt.Fprintf(&b, "maxclients:%d\r\n", 0)
+	// No command blocks the connection waiting for data yet
+	fmt.Fprintf(&b, "blocked_clients:%d\r\n", 0)
+	return b.String()
+}
+
+// infoStats renders the stats section of the INFO command
+func infoStats(stats *metrics.Collector) string {
+	var b strings.Builder
+	b.WriteString("# Stats\r\n")
+	fmt.Fprintf(&b, "total_commands_processed:%d\r\n", stats.CommandsProcessed())
+	fmt.Fprintf(&b, "expired_keys:%d\r\n", stats.ExpiredKeys())
+	fmt.Fprintf(&b, "evicted_keys:%d\r\n", stats.EvictedKeys())
+	fmt.Fprintf(&b, "keyspace_hits:%d\r\n", stats.KeyspaceHits())
+	fmt.Fprintf(&b, "keyspace_misses:%d\r\n", stats.KeyspaceMisses())
+	return b.String()
+}
+
+// infoCommandStats renders the commandstats section of the INFO command
+func infoCommandStats(stats *metrics.Collector) string {
+	var b strings.Builder
+	b.WriteString("# Commandstats\r\n")
+	commands := stats.CommandStats()
+	for _, name := range stats.CommandNames() {
+		stat := commands[name]
+		fmt.Fprintf(&b, "cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f\r\n", name, stat.Calls, stat.Usec, stat.UsecPerCall())
+	}
+	return b.String()
+}
+
+// infoReplication renders the replication section of the INFO command
+func infoReplication(repl *replication.State) string {
+	info := repl.Info()
+	var b strings.Builder
+	b.WriteString("# Replication\r\n")
+	fmt.Fprintf(&b, "role:%s\r\n", info.Role)
+	if info.MasterAddr != "" {
+		host, port, _ := net.SplitHostPort(info.MasterAddr)
+		fmt.Fprintf(&b, "master_host:%s\r\n", host)
+		fmt.Fprintf(&b, "master_port:%s\r\n", port)
+	}
+	fmt.Fprintf(&b, "connected_slaves:%d\r\n", info.ConnectedReplicas)
+	fmt.Fprintf(&b, "master_repl_offset:%d\r\n", info.Offset)
+	fmt.Fprintf(&b, "repl_backlog_active:1\r\n")
+	fmt.Fprintf(&b, "repl_backlog_size:%d\r\n", info.BacklogSize)
+	fmt.Fprintf(&b, "repl_backlog_first_byte_offset:%d\r\n", info.BacklogFirstByteOffset)
+	fmt.Fprintf(&b, "repl_backlog_histlen:%d\r\n", info.BacklogHistLen)
+	return b.String()
+}
+
+// infoKeyspace renders the keyspace section of the INFO command.
+// There is a single database, which is only listed when it isn't empty.
+func infoKeyspace(store Store, ttl *ttlstore.TTLStore) string {
+	var b strings.Builder
+	b.WriteString("# Keyspace\r\n")
+	if keys := store.Len(); keys > 0 {
+		fmt.Fprintf(&b, "db0:keys=%d,expires=%d,avg_ttl=0\r\n", keys, ttl.Len())
+	}
+	return b.String()
+}
+
+// info renders the requested INFO section, or all sections if section is empty.
+// Unknown sections render as an empty string, like in Redis.
+func info(section string, store Store, ttl *ttlstore.TTLStore, repl *replication.State) string {
+	switch strings.ToLower(section) {
+	case "", "default":
+		return strings.Join([]string{
+			infoServer(),
+			infoClients(metrics.Default()),
+			infoStats(metrics.Default()),
+			infoReplication(repl),
+			infoKeyspace(store, ttl),
+		}, "\r\n")
+	case "all", "everything":
+		return strings.Join([]string{
+			infoServer(),
+			infoClients(metrics.Default()),
+			infoStats(metrics.Default()),
+			infoReplication(repl),
+			infoCommandStats(metrics.Default()),
+			infoKeyspace(store, ttl),
+		}, "\r\n")
+	case "server":
+		return infoServer()
+	case "clients":
+		return infoClients(metrics.Default())
+	case "stats":
+		return infoStats(metrics.Default())
+	case "commandstats":
+		return infoCommandStats(metrics.Default())
+	case "replication":
+		return infoReplication(repl)
+	case "keyspace":
+		return infoKeyspace(store, ttl)
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,68 @@
+package protocol
+
+// lcsMatch is a pair of matching ranges in the two strings compared by LCS, bounds included
+type lcsMatch struct {
+	aStart, aEnd int
+	bStart, bEnd int
+}
+
+// Len returns the length of the matching ranges
+func (m lcsMatch) Len() int {
+	return m.aEnd - m.aStart + 1
+}
+
+// lcs computes the longest common subsequence of a and b along with the
+// ranges it is made of. Like in Redis, ranges are returned from the end of the strings.
+func lcs(a, b string) (string, []lcsMatch) {
+	// table[i][j] is the length of the LCS of a[:i] and b[:j]
+	table := make([][]int, len(a)+1)
+	for i := range table {
+		table[i] = make([]int, len(b)+1)
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			if a[i-1] == b[j-1] {
+				table[i][j] = table[i-1][j-1] + 1
+			} else {
+				table[i][j] = max(table[i-1][j], table[i][j-1])
+			}
+		}
+	}
+
+	// Walk the table back from the end collecting the subsequence and its ranges
+	result := make([]byte, table[len(a)][len(b)])
+	idx := len(result)
+	var matches []lcsMatch
+	var current *lcsMatch
+	i, j := len(a), len(b)
+	for i > 0 && j > 0 {
+		emit := false
+		if a[i-1] == b[j-1] {
+			idx--
+			result[idx] = a[i-1]
+			if current == nil {
+				current = &lcsMatch{aStart: i - 1, aEnd: i - 1, bStart: j - 1, bEnd: j - 1}
+			} else {
+				// Walking back along the diagonal extends the current range
+				current.aStart--
+				current.bStart--
+			}
+			// The range can't be extended past the first byte of either string
+			emit = current.aStart == 0 || current.bStart == 0
+			i--
+			j--
+		} else {
+			if table[i-1][j] > table[i][j-1] {
+				i--
+			} else {
+				j--
+			}
+			emit = current != nil
+		}
+		if emit {
+			matches = append(matches, *current)
+			current = nil
+		}
+	}
+	return string(result), matches
+}
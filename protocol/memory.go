@@ -0,0 +1,79 @@
+package protocol
+
+import (
+	"fmt"
+	"github.com/pilosus/goradieschen/eviction"
+	"github.com/pilosus/goradieschen/replication"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// memoryWarnRatio is the share of maxmemory used above which MEMORY DOCTOR reports a problem
+const memoryWarnRatio = 0.9
+
+// embstrSizeLimit is the longest string Redis stores with the embstr encoding
+const embstrSizeLimit = 44
+
+// stringEncoding returns the encoding Redis would pick for a string value.
+// Values modified in place by APPEND or SETRANGE keep the raw encoding.
+func stringEncoding(val string, raw bool) string {
+	if raw {
+		return "raw"
+	}
+	if n, err := strconv.ParseInt(val, 10, 64); err == nil && strconv.FormatInt(n, 10) == val {
+		return "int"
+	}
+	if len(val) <= embstrSizeLimit {
+		return "embstr"
+	}
+	return "raw"
+}
+
+// debugObject renders the DEBUG OBJECT reply for a value idle for the given time.
+// Only strings are stored, so the serialized length is the length of the value.
+func debugObject(val string, raw bool, idle time.Duration) string {
+	refCount := 1
+	if !raw && isSharedInteger(val) {
+		refCount = sharedRefCount
+	}
+	return fmt.Sprintf("Value at:0x0 refcount:%d encoding:%s serializedlength:%d lru_seconds_idle:%d",
+		refCount, stringEncoding(val, raw), len(val), int64(idle.Seconds()))
+}
+
+// memoryStats renders the reply of MEMORY STATS as a flat list of metric names and values
+func memoryStats(store Store, repl *replication.State) []interface{} {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	keys := int64(store.Len())
+	dataset := store.UsedMemory()
+	allocated := int64(ms.HeapAlloc)
+	bytesPerKey := int64(0)
+	if keys > 0 {
+		bytesPerKey = dataset / keys
+	}
+	return []interface{}{
+		"total.allocated", allocated,
+		"total.system", int64(ms.Sys),
+		"replication.backlog", int64(repl.Info().BacklogSize),
+		"overhead.total", max(allocated-dataset, 0),
+		"keys.count", keys,
+		"keys.bytes-per-key", bytesPerKey,
+		"dataset.bytes", dataset,
+	}
+}
+
+// memoryDoctor renders a human-readable assessment of the memory usage for MEMORY DOCTOR
+func memoryDoctor(store Store, evict *eviction.Evictor) string {
+	if store.Len() == 0 {
+		return "This instance is empty or is using very little memory, there is nothing to report."
+	}
+	used, limit := store.UsedMemory(), evict.MaxMemory()
+	if limit > 0 && float64(used) > float64(limit)*memoryWarnRatio {
+		return fmt.Sprintf("The dataset takes %d bytes, close to the maxmemory limit of %d bytes. "+
+			"Consider raising the limit or setting TTLs for keys to be evicted with the %s policy.",
+			used, limit, evict.Policy())
+	}
+	return "No memory issues found."
+}
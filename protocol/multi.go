@@ -0,0 +1,80 @@
+package protocol
+
+import (
+	"strconv"
+	"strings"
+)
+
+// isTransactionControl reports whether the command is run right away inside a transaction instead of being queued
+func isTransactionControl(name string) bool {
+	switch name {
+	case "MULTI", "EXEC", "DISCARD", "QUIT", "RESET":
+		return true
+	}
+	return false
+}
+
+// queueCommand queues a command of the transaction. Commands that can't be
+// run at all are rejected right away and make the transaction fail on EXEC.
+func (s *Session) queueCommand(name, cmd string, cmdArgs []string) string {
+	c, ok := lookupCommand(name)
+	switch {
+	case !ok:
+		s.multiFailed = true
+		return unknownCommandError(cmd)
+	case !c.checkArity(len(cmdArgs) + 1):
+		s.multiFailed = true
+		return arityError(name)
+	case hasFlag(name, "no-multi"):
+		s.multiFailed = true
+		return EncodeError(GenericErrorPrefix + " Command not allowed inside a transaction")
+	}
+	s.Queue = append(s.Queue, append([]string{cmd}, cmdArgs...))
+	return EncodeSimpleString("QUEUED")
+}
+
+// execQueue runs the queued commands one after another and replies with an array of their replies.
+// A command failing at runtime doesn't stop the rest, its error is returned in place of its reply.
+// The permissions are checked again, as they may have changed since the commands were queued.
+func (s *Session) execQueue(queue [][]string) string {
+	// The handlers reset the context and reader of the session once they return
+	ctx, reader := s.ctx, s.reader
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(queue)) + "\r\n")
+	s.transaction(func() {
+		for _, args := range queue {
+			name := strings.ToUpper(args[0])
+			keys, _ := getKeys(append([]string{name}, args[1:]...))
+			if reply := s.checkCommand(name, keys); reply != "" {
+				b.WriteString(reply)
+				continue
+			}
+			b.WriteString(s.call(ctx, name, args[0], args[1:], keys, reader))
+		}
+	})
+	return b.String()
+}
+
+// transaction runs fn holding the replication write lock, so that no other write
+// interleaves with it. The writes fn does are propagated as a single MULTI/EXEC unit.
+func (s *Session) transaction(fn func()) {
+	s.repl.WriteFunc(func(propagate func(payload string)) {
+		var payloads []string
+		s.propagate = func(payload string) {
+			payloads = append(payloads, payload)
+		}
+		// The writes done so far are propagated even if a command panics
+		defer func() {
+			s.propagate = nil
+			if len(payloads) > 0 {
+				propagate(EncodeArray([]string{"MULTI"}) + strings.Join(payloads, "") + EncodeArray([]string{"EXEC"}))
+			}
+		}()
+		fn()
+	})
+}
+
+// discardTransaction leaves the transaction, dropping the queued commands
+func (s *Session) discardTransaction() {
+	s.multi, s.multiFailed, s.Queue = false, false, nil
+}
@@ -2,115 +2,335 @@ package protocol
 
 import (
 	"bufio"
-	"github.com/pilosus/goradieschen/store"
+	"context"
+	"errors"
+	"github.com/pilosus/goradieschen/logger"
+	"github.com/pilosus/goradieschen/metrics"
+	"github.com/pilosus/goradieschen/replication"
 	"github.com/pilosus/goradieschen/ttlstore"
+	"io"
+	"math"
+	"net"
 	"strconv"
 	"strings"
 	"time"
 )
 
 const GenericErrorPrefix = "ERR"
+const ReadOnlyErrorPrefix = "READONLY"
+const OOMErrorPrefix = "OOM"
+const NoAuthErrorPrefix = "NOAUTH"
+const NoPermErrorPrefix = "NOPERM"
+const NoProtoErrorPrefix = "NOPROTO"
+const ExecAbortErrorPrefix = "EXECABORT"
+const WrongPassErrorPrefix = "WRONGPASS"
+const WrongTypeErrorPrefix = "WRONGTYPE"
 const ReturnOK = "OK"
 
-func ParseCommand(reader *bufio.Reader, store *store.Store, ttl *ttlstore.TTLStore) string {
+// sharedIntegers is the number of small integers Redis keeps as shared objects
+const sharedIntegers = 10000
+
+// sharedRefCount is the reference count Redis reports for shared objects
+const sharedRefCount = math.MaxInt32
+
+// ParseCommand reads a single command from the client and executes it.
+// It returns the reply to write, which may be empty, and whether the connection
+// has to be closed afterwards. Long-running commands abort early once ctx is cancelled.
+func (s *Session) ParseCommand(ctx context.Context, reader *bufio.Reader) (string, bool) {
+	reply := s.parseCommand(ctx, reader)
+	return reply, s.closing
+}
+
+func (s *Session) parseCommand(ctx context.Context, reader *bufio.Reader) string {
 	cmd, cmdArgs, err := DecodeCommand(reader)
 	if err != nil {
+		// Nothing can be replied once the client is gone
+		var opErr *net.OpError
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &opErr) {
+			s.closing = true
+			return ""
+		}
+		var protoErr *ProtocolError
+		if errors.As(err, &protoErr) {
+			s.closing = true
+		}
 		return EncodeError(GenericErrorPrefix + " " + err.Error())
 	}
 
-	switch strings.ToUpper(cmd) {
-	case "SET":
-		if len(cmdArgs) != 2 {
-			return EncodeError(GenericErrorPrefix + " usage: SET key value")
+	name := strings.ToUpper(cmd)
+	keys, _ := getKeys(append([]string{name}, cmdArgs...))
+	if reply := s.checkCommand(name, keys); reply != "" {
+		// A rejected command makes the transaction it was meant for fail on EXEC
+		if s.multi {
+			s.multiFailed = true
 		}
-		store.Set(cmdArgs[0], cmdArgs[1])
-		return EncodeSimpleString(ReturnOK)
-	case "GET":
-		if len(cmdArgs) != 1 {
-			return EncodeError(GenericErrorPrefix + " usage: GET key")
+		return reply
+	}
+	// Inside a transaction commands are queued until EXEC, except for the ones ending it
+	if s.multi && !isTransactionControl(name) {
+		return s.queueCommand(name, cmd, cmdArgs)
+	}
+	return s.call(ctx, name, cmd, cmdArgs, keys, reader)
+}
+
+// checkCommand returns the error reply if the client may not run the command, or an empty string
+func (s *Session) checkCommand(name string, keys []string) string {
+	if !s.Authenticated && !hasFlag(name, "no-auth") {
+		return EncodeError(NoAuthErrorPrefix + " Authentication required.")
+	}
+	if _, ok := lookupCommand(name); ok && !s.users.CanRun(s.User, name) {
+		return EncodeError(NoPermErrorPrefix + " User " + s.User + " has no permissions to run the '" + strings.ToLower(name) + "' command")
+	}
+	for _, key := range keys {
+		if !s.users.CanAccess(s.User, key) {
+			return EncodeError(NoPermErrorPrefix + " No permissions to access a key")
 		}
-		val, ok := store.Get(cmdArgs[0])
-		if !ok {
-			return EncodeNullBulkString()
+	}
+	if s.repl.ReadOnly() && IsWrite(name) {
+		return EncodeError(ReadOnlyErrorPrefix + " You can't write against a read only replica.")
+	}
+	return ""
+}
+
+// call runs a command the client is allowed to run, keeping the statistics
+func (s *Session) call(ctx context.Context, name, cmd string, cmdArgs, keys []string, reader *bufio.Reader) string {
+	// A write command expires its keys under the same lock it runs with, so that it
+	// never builds on a value whose background expiration is still to be applied
+	if IsWrite(name) && s.propagate == nil {
+		var reply string
+		s.writeLocked(func() {
+			reply = s.call(ctx, name, cmd, cmdArgs, keys, reader)
+		})
+		return reply
+	}
+	// Expired keys are removed lazily before the command gets to see them
+	for _, key := range keys {
+		s.expireIfNeeded(key)
+	}
+	// Commands that may grow the dataset first make room for it
+	if hasFlag(name, "denyoom") {
+		if err := s.evict.Evict(s.evictKey); err != nil {
+			return EncodeError(OOMErrorPrefix + " " + err.Error())
 		}
-		return EncodeBulkString(&val)
-	case "DEL":
-		if len(cmdArgs) != 1 {
-			return EncodeError(GenericErrorPrefix + " usage: DEL key")
+	}
+
+	start := time.Now()
+	_, known := lookupCommand(name)
+	if known {
+		s.lastCommand = strings.ToLower(name)
+		s.commands++
+	}
+	s.lastInteraction = start
+	// The connection handler recovers from the panic, it only knows the client though
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Errorf("Command %s panicked: %v", name, r)
+			panic(r)
 		}
-		deleted := store.Delete(cmdArgs[0])
+	}()
+	reply := s.dispatch(ctx, name, cmd, cmdArgs, reader)
+	latency := time.Since(start)
+	logger.Debugf("Command %s executed in %s", name, latency)
+	// Unknown commands aren't counted to keep the set of per-command metrics bounded
+	if known {
+		metrics.Default().CommandProcessed(name, latency)
+	}
+	return reply
+}
+
+// applyCommand executes a command streamed by the primary. Unlike ParseCommand,
+// it bypasses the read-only check and discards the reply. The commands of a
+// transaction are collected until its EXEC and applied as a unit.
+func (s *Session) applyCommand(ctx context.Context, reader *bufio.Reader) error {
+	cmd, cmdArgs, err := DecodeCommand(reader)
+	if err != nil {
+		return err
+	}
+	switch name := strings.ToUpper(cmd); {
+	case name == "MULTI":
+		s.multi = true
+	case name == "EXEC" && s.multi:
+		queue := s.Queue
+		s.discardTransaction()
+		s.transaction(func() {
+			for _, args := range queue {
+				s.dispatch(ctx, strings.ToUpper(args[0]), args[0], args[1:], reader)
+			}
+		})
+	case s.multi:
+		s.Queue = append(s.Queue, append([]string{cmd}, cmdArgs...))
+	default:
+		s.dispatch(ctx, name, cmd, cmdArgs, reader)
+	}
+	return nil
+}
+
+// dispatch executes a command. Successful write commands are propagated to replicas.
+func (s *Session) dispatch(ctx context.Context, name, cmd string, cmdArgs []string, reader *bufio.Reader) string {
+	if !IsWrite(name) {
+		return s.execute(ctx, name, cmd, cmdArgs, reader)
+	}
+	payload := EncodeArray(append([]string{cmd}, cmdArgs...))
+	return s.write(payload, func() (string, bool) {
+		reply := s.execute(ctx, name, cmd, cmdArgs, reader)
+		return reply, !strings.HasPrefix(reply, "-")
+	})
+}
+
+// write runs a write via exec and propagates payload to replicas if exec reports success.
+// It takes the replication write lock, unless the session holds it already.
+func (s *Session) write(payload string, exec func() (string, bool)) string {
+	if s.propagate == nil {
+		return s.repl.Write(payload, exec)
+	}
+	reply, ok := exec()
+	if ok {
+		s.propagate(payload)
+	}
+	return reply
+}
+
+// writeLocked runs fn holding the replication write lock, the writes fn does through
+// write are executed and propagated as a unit
+func (s *Session) writeLocked(fn func()) {
+	s.repl.WriteFunc(func(propagate func(payload string)) {
+		s.propagate = propagate
+		defer func() { s.propagate = nil }()
+		fn()
+	})
+}
+
+// deleteKey removes the key along with its TTL, reporting whether the key existed.
+// Commands delete keys only through it or deleteKeys, so that no stale TTL is left behind.
+func (s *Session) deleteKey(key string) bool {
+	s.ttl.Remove(key)
+	return s.store.Delete(key)
+}
+
+// deleteKeys removes the keys along with their TTLs, returning the number of keys that existed
+func (s *Session) deleteKeys(keys []string) int {
+	s.ttl.RemoveMany(keys)
+	return s.store.DeleteMany(keys)
+}
+
+// setKey stores the value and drops the TTL the key had, like SET does in Redis
+func (s *Session) setKey(key, value string) {
+	// Dropping the TTL first keeps a pending expiration from deleting the new value
+	s.ttl.Remove(key)
+	s.store.Set(key, value)
+}
+
+// flushAll removes all keys along with their TTLs
+func (s *Session) flushAll() {
+	s.store.FlushAll()
+	s.ttl.FlushAll()
+}
+
+// evictKey deletes a key chosen by the eviction policy and propagates the deletion to replicas
+func (s *Session) evictKey(key string) {
+	s.write(EncodeArray([]string{"DEL", key}), func() (string, bool) {
+		deleted := s.deleteKey(key)
 		if deleted {
-			return EncodeSimpleString(ReturnOK)
-		}
-		return EncodeNullBulkString()
-	case "KEYS":
-		if len(cmdArgs) != 1 {
-			return EncodeError(GenericErrorPrefix + " usage: KEYS pattern")
-		}
-		val, ok := store.Match(cmdArgs[0])
-		if !ok {
-			return EncodeNullBulkString()
+			logger.Debugf("Key evicted: %s", key)
+			metrics.Default().KeyEvicted()
 		}
-		return EncodeArray(val)
-	case "EXPIRE":
-		if len(cmdArgs) != 2 {
-			return EncodeError(GenericErrorPrefix + " usage: EXPIRE key seconds")
-		}
-		seconds, err := strconv.Atoi(cmdArgs[1])
-		if err != nil || seconds < 0 {
-			return EncodeError(GenericErrorPrefix + " invalid seconds value: " + cmdArgs[1])
-		}
-		_, ok := store.Get(cmdArgs[0])
-		// If the key does not exist, no need to set TTL
-		if !ok {
-			return EncodeInteger(0)
-		}
-		expiresAt := time.Now().Add(time.Duration(seconds) * time.Second)
-		ttl.SetTTL(cmdArgs[0], expiresAt)
-		return EncodeInteger(1)
-	case "TTL":
-		if len(cmdArgs) != 1 {
-			return EncodeError(GenericErrorPrefix + " usage: TTL key")
-		}
-		_, ok := store.Get(cmdArgs[0])
-		if !ok {
-			return EncodeInteger(-2) // Key does not exist
-		}
-		expiresAt, ok := ttl.GetTTL(cmdArgs[0])
-		if !ok {
-			return EncodeInteger(-1) // Key exists but has no TTL set
-		}
-		remaining := expiresAt.Sub(time.Now()).Seconds()
-		if remaining < 0 {
-			return EncodeInteger(0) // Key has expired
-		}
-		return EncodeInteger(int64(remaining))
-	case "FLUSHALL":
-		if len(cmdArgs) != 0 {
-			return EncodeError(GenericErrorPrefix + " usage: FLUSHALL")
+		return "", deleted
+	})
+}
+
+// expireIfNeeded deletes the key if its TTL has passed and propagates the deletion
+// to replicas. It reports whether the key has expired. A key picked up by the background
+// expiration is deleted right away too, which cancels the pending deletion.
+func (s *Session) expireIfNeeded(key string) bool {
+	if !s.ttl.Expired(key) {
+		return false
+	}
+	s.write(EncodeArray([]string{"DEL", key}), func() (string, bool) {
+		// The background expiration may have deleted the key in the meantime
+		if !s.ttl.Expired(key) {
+			return "", false
 		}
-		store.FlushAll()
-		ttl.FlushAll()
-		return EncodeSimpleString(ReturnOK)
-	case "PING":
-		return "PONG"
-	case "COMMAND":
-		if len(cmdArgs) != 0 {
-			return EncodeError(GenericErrorPrefix + " usage: COMMAND")
+		s.deleteKey(key)
+		logger.Debugf("Key expired: %s", key)
+		metrics.Default().KeyExpired()
+		return "", true
+	})
+	return true
+}
+
+// ExpireKey deletes a key whose TTL has expired in the background and propagates the
+// deletion to replicas, like expireIfNeeded does. It's meant to be the DeleteFn of the
+// TTLStore shared by the sessions.
+func ExpireKey(store Store, ttl *ttlstore.TTLStore, repl *replication.State, key string) {
+	repl.Write(EncodeArray([]string{"DEL", key}), func() (string, bool) {
+		// The key may have been set again or given a new TTL since it expired
+		if !ttl.ClaimExpired(key) {
+			return "", false
 		}
-		commands := []interface{}{
-			[]interface{}{"SET", int64(3), []interface{}{"write"}, int64(1), int64(1), int64(1)},
-			[]interface{}{"GET", int64(2), []interface{}{"readonly"}, int64(1), int64(1), int64(1)},
-			[]interface{}{"DEL", int64(2), []interface{}{"write"}, int64(1), int64(1), int64(1)},
-			[]interface{}{"KEYS", int64(2), []interface{}{"readonly"}, int64(1), int64(1), int64(1)},
-			[]interface{}{"EXPIRE", int64(3), []interface{}{"write"}, int64(1), int64(1), int64(1)},
-			[]interface{}{"TTL", int64(2), []interface{}{"readonly"}, int64(1), int64(1), int64(1)},
-			[]interface{}{"FLUSHALL", int64(1), []interface{}{"write"}, int64(0), int64(0), int64(0)},
-			[]interface{}{"PING", int64(1), []interface{}{"stale", "fast"}, int64(0), int64(0), int64(0)},
-			[]interface{}{"COMMAND", int64(1), []interface{}{"readonly"}, int64(0), int64(0), int64(0)},
+		store.Delete(key)
+		logger.Debugf("Key expired: %s", key)
+		metrics.Default().KeyExpired()
+		return "", true
+	})
+}
+
+// fullSync encodes the whole dataset as a stream of commands rebuilding it on a replica
+func fullSync(store Store, ttl *ttlstore.TTLStore) string {
+	var b strings.Builder
+	b.WriteString(EncodeArray([]string{"FLUSHALL"}))
+	// The dataset is encoded from a copy rather than with the store locked
+	snapshot := takeSnapshot(store, ttl)
+	for key, value := range snapshot.Data {
+		b.WriteString(EncodeArray([]string{"SET", key, value}))
+		if expiresAt, ok := snapshot.Expires[key]; ok {
+			seconds := int64(math.Ceil(time.Until(expiresAt).Seconds()))
+			b.WriteString(EncodeArray([]string{"EXPIRE", key, strconv.FormatInt(max(seconds, 0), 10)}))
 		}
-		return EncodeArrayMixed(commands)
-	default:
-		return EncodeError(GenericErrorPrefix + " unknown command: " + cmd)
 	}
+	return b.String()
+}
+
+// isSharedInteger reports whether Redis would store the value as a shared integer object:
+// a canonical decimal representation of an integer in the 0..9999 range
+func isSharedInteger(val string) bool {
+	n, err := strconv.ParseInt(val, 10, 64)
+	return err == nil && n >= 0 && n < sharedIntegers && strconv.FormatInt(n, 10) == val
+}
+
+// lookupRead looks up a key on behalf of a read command,
+// counting a keyspace hit or miss depending on whether it exists
+func (s *Session) lookupRead(key string) (string, bool) {
+	get := s.store.Get
+	if s.NoTouch {
+		get = s.store.Peek
+	}
+	val, ok := get(key)
+	if ok {
+		metrics.Default().KeyspaceHit()
+	} else {
+		metrics.Default().KeyspaceMiss()
+	}
+	return val, ok
+}
+
+// execute looks up the command in the registry, checks its arity and runs the handler
+func (s *Session) execute(ctx context.Context, name, cmd string, cmdArgs []string, reader *bufio.Reader) string {
+	c, ok := lookupCommand(name)
+	if !ok {
+		return unknownCommandError(cmd)
+	}
+	if !c.checkArity(len(cmdArgs) + 1) {
+		return arityError(name)
+	}
+	s.ctx, s.reader = ctx, reader
+	defer func() { s.ctx, s.reader = nil, nil }()
+	return c.Handler(s, cmdArgs)
+}
+
+func unknownCommandError(cmd string) string {
+	return EncodeError(GenericErrorPrefix + " unknown command: " + cmd)
+}
+
+func arityError(name string) string {
+	return EncodeError(GenericErrorPrefix + " wrong number of arguments for '" + strings.ToLower(name) + "' command")
 }
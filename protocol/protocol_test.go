@@ -0,0 +1,2412 @@
+package protocol
+
+import (
+	"bufio"
+	"context"
+	"github.com/pilosus/goradieschen/acl"
+	"github.com/pilosus/goradieschen/eviction"
+	"github.com/pilosus/goradieschen/metrics"
+	"github.com/pilosus/goradieschen/replication"
+	"github.com/pilosus/goradieschen/store"
+	"github.com/pilosus/goradieschen/ttlstore"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// encodeCommand encodes command arguments as a RESP2 array of bulk strings
+func encodeCommand(args ...string) string {
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		b.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	return b.String()
+}
+
+type testServer struct {
+	store   *store.Store
+	ttl     *ttlstore.TTLStore
+	repl    *replication.State
+	evict   *eviction.Evictor
+	users   *acl.ACL
+	session *Session
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	ts := &testServer{
+		store: store.NewStore(),
+		repl:  replication.NewState(),
+		users: acl.New(),
+	}
+	ts.ttl = ttlstore.NewTTLStore(ctx, func(key string) { ExpireKey(ts.store, ts.ttl, ts.repl, key) })
+	ts.evict = eviction.New(ts.store, ts.ttl)
+	ts.session = ts.newSession(io.Discard)
+	return ts
+}
+
+func (ts *testServer) newSession(conn io.Writer) *Session {
+	return NewSession(conn, ts.store, ts.ttl, ts.repl, ts.evict, ts.users)
+}
+
+// run executes a single command in the default session and returns its encoded reply
+func (ts *testServer) run(args ...string) string {
+	return runIn(ts.session, args...)
+}
+
+// runIn executes a single command in the given session and returns its encoded reply
+func runIn(session *Session, args ...string) string {
+	return runInContext(context.Background(), session, args...)
+}
+
+// runInContext executes a single command in the given session using ctx
+func runInContext(ctx context.Context, session *Session, args ...string) string {
+	reader := bufio.NewReader(strings.NewReader(encodeCommand(args...)))
+	reply, _ := session.ParseCommand(ctx, reader)
+	return reply
+}
+
+// serve accepts client connections on a random local port until the test ends
+func (ts *testServer) serve(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				reader := bufio.NewReader(conn)
+				session := ts.newSession(conn)
+				for {
+					response, closeConn := session.ParseCommand(context.Background(), reader)
+					if _, err := conn.Write([]byte(response)); err != nil {
+						return
+					}
+					if closeConn {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// waitFor polls cond until it holds or the timeout elapses
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestReadOnlyReplica(t *testing.T) {
+	ts := newTestServer(t)
+	readOnlyErr := EncodeError("READONLY You can't write against a read only replica.")
+
+	if got := ts.run("SET", "k", "v1"); got != "+OK\r\n" {
+		t.Fatalf("expected SET to succeed, got %q", got)
+	}
+
+	ts.repl.SetReadOnly(true)
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{name: "SET is rejected", args: []string{"SET", "k", "v2"}, expected: readOnlyErr},
+		{name: "DEL is rejected", args: []string{"DEL", "k"}, expected: readOnlyErr},
+		{name: "EXPIRE is rejected", args: []string{"EXPIRE", "k", "10"}, expected: readOnlyErr},
+		{name: "FLUSHALL is rejected", args: []string{"FLUSHALL"}, expected: readOnlyErr},
+		{name: "lowercase write is rejected", args: []string{"set", "k", "v2"}, expected: readOnlyErr},
+		{name: "GET still works", args: []string{"GET", "k"}, expected: "$2\r\nv1\r\n"},
+		{name: "TTL still works", args: []string{"TTL", "k"}, expected: ":-1\r\n"},
+		{name: "PING still works", args: []string{"PING"}, expected: "+PONG\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ts.run(tt.args...); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+
+	ts.repl.SetReadOnly(false)
+	if got := ts.run("SET", "k", "v3"); got != "+OK\r\n" {
+		t.Fatalf("expected SET to succeed after disabling read-only, got %q", got)
+	}
+}
+
+func TestReplicaOf(t *testing.T) {
+	primary := newTestServer(t)
+	replica := newTestServer(t)
+	t.Cleanup(replica.repl.StopReplication)
+
+	primary.run("SET", "existing", "v0")
+	primary.run("SET", "volatile", "v0")
+	primary.run("EXPIRE", "volatile", "100")
+	replica.run("SET", "stale", "gone after full sync")
+
+	host, port, _ := net.SplitHostPort(primary.serve(t))
+	if got := replica.run("REPLICAOF", host, port); got != "+OK\r\n" {
+		t.Fatalf("expected REPLICAOF to succeed, got %q", got)
+	}
+	if !waitFor(t, 2*time.Second, func() bool { return primary.repl.Replicas() == 1 }) {
+		t.Fatal("replica did not connect to the primary")
+	}
+
+	t.Run("full sync loads the primary dataset", func(t *testing.T) {
+		if got, _ := replica.store.Get("existing"); got != "v0" {
+			t.Errorf("expected existing key to be synced, got %q", got)
+		}
+		if _, ok := replica.store.Get("stale"); ok {
+			t.Error("expected stale replica key to be flushed")
+		}
+		if _, ok := replica.ttl.GetTTL("volatile"); !ok {
+			t.Error("expected TTL to be synced")
+		}
+	})
+
+	t.Run("writes on the primary appear on the replica", func(t *testing.T) {
+		primary.run("SET", "k", "v1")
+		primary.run("DEL", "existing")
+		ok := waitFor(t, 2*time.Second, func() bool {
+			v, _ := replica.store.Get("k")
+			_, exists := replica.store.Get("existing")
+			return v == "v1" && !exists
+		})
+		if !ok {
+			t.Fatal("write was not propagated to the replica")
+		}
+	})
+
+	t.Run("keys expired in the background are deleted on the replica", func(t *testing.T) {
+		// The replica doesn't expire keys on its own, it relies on the primary
+		replica.run("DEBUG", "SET-ACTIVE-EXPIRE", "0")
+		defer replica.run("DEBUG", "SET-ACTIVE-EXPIRE", "1")
+		primary.run("SET", "short", "v", "PX", "50")
+		if !waitFor(t, 2*time.Second, func() bool { _, ok := replica.store.Get("short"); return ok }) {
+			t.Fatal("write was not propagated to the replica")
+		}
+		ok := waitFor(t, 2*time.Second, func() bool {
+			_, exists := replica.store.Get("short")
+			return !exists
+		})
+		if !ok {
+			t.Fatal("expiration was not propagated to the replica")
+		}
+		if _, exists := replica.ttl.GetTTL("short"); exists {
+			t.Error("expected the TTL to be removed on the replica")
+		}
+	})
+
+	t.Run("REPLICAOF NO ONE stops replication", func(t *testing.T) {
+		if got := replica.run("REPLICAOF", "NO", "ONE"); got != "+OK\r\n" {
+			t.Fatalf("expected OK, got %q", got)
+		}
+		if !waitFor(t, 2*time.Second, func() bool { return primary.repl.Replicas() == 0 }) {
+			t.Fatal("primary still tracks the replica")
+		}
+		primary.run("SET", "k", "v2")
+		time.Sleep(50 * time.Millisecond)
+		if got, _ := replica.store.Get("k"); got != "v1" {
+			t.Errorf("expected replica to keep k=v1 after unlinking, got %q", got)
+		}
+	})
+}
+
+func TestInfoReplicationOffset(t *testing.T) {
+	ts := newTestServer(t)
+
+	writes := [][]string{
+		{"SET", "k1", "v1"},
+		{"SET", "k2", "v2"},
+		{"EXPIRE", "k1", "100"},
+		{"DEL", "k2"},
+	}
+	var expected strings.Builder
+	for _, args := range writes {
+		ts.run(args...)
+		expected.WriteString(encodeCommand(args...))
+	}
+	// Reads and failed writes don't advance the offset
+	ts.run("GET", "k1")
+	ts.run("EXPIRE", "k1", "not-a-number")
+
+	if got := string(ts.repl.BacklogBytes()); got != expected.String() {
+		t.Errorf("expected backlog %q, got %q", expected.String(), got)
+	}
+
+	reply := ts.run("INFO", "replication")
+	offsetLine := "master_repl_offset:" + strconv.Itoa(expected.Len()) + "\r\n"
+	if !strings.Contains(reply, offsetLine) {
+		t.Errorf("expected INFO replication to contain %q, got %q", offsetLine, reply)
+	}
+	if !strings.Contains(reply, "role:master\r\n") {
+		t.Errorf("expected INFO replication to report the master role, got %q", reply)
+	}
+}
+
+func TestReset(t *testing.T) {
+	ts := newTestServer(t)
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{name: "RESET replies with RESET status", args: []string{"RESET"}, expected: "+RESET\r\n"},
+		{name: "RESET is case-insensitive", args: []string{"reset"}, expected: "+RESET\r\n"},
+		{name: "RESET takes no arguments", args: []string{"RESET", "now"}, expected: "-ERR wrong number of arguments for 'reset' command\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ts.run(tt.args...); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestResetConnectionState(t *testing.T) {
+	ts := newTestServer(t)
+	ts.run("ACL", "SETUSER", "reader", "on", ">secret", "~*", "+get", "+client", "+hello", "+multi", "+reset")
+	ts.run("ACL", "SETUSER", "default", ">pass")
+	session := ts.newSession(io.Discard)
+
+	for _, args := range [][]string{
+		{"HELLO", "2", "AUTH", "reader", "secret", "SETNAME", "app"},
+		{"CLIENT", "NO-TOUCH", "ON"},
+		{"CLIENT", "NO-EVICT", "ON"},
+		{"MULTI"},
+	} {
+		if got := runIn(session, args...); strings.HasPrefix(got, "-") {
+			t.Fatalf("%s: unexpected error %q", args, got)
+		}
+	}
+	// Neither SELECT, SUBSCRIBE nor RESP3 exist yet, the state is set directly
+	session.DB, session.Protocol = 1, 3
+	session.Subscriptions["channel"] = struct{}{}
+
+	// The password of the default user is required again, RESET runs anyway
+	if got := runIn(session, "RESET"); got != "+RESET\r\n" {
+		t.Fatalf("expected RESET, got %q", got)
+	}
+	if session.DB != 0 || session.Protocol != 2 || session.Name != "" || session.NoTouch || session.NoEvict ||
+		session.User != "default" || session.Authenticated || len(session.Subscriptions) != 0 || session.multi {
+		t.Errorf("expected the state of a new connection, got %+v", session)
+	}
+	if got := runIn(session, "GET", "key"); got != "-NOAUTH Authentication required.\r\n" {
+		t.Errorf("expected the client to authenticate again, got %q", got)
+	}
+
+	// Without a password the client is authenticated as the default user
+	ts.run("ACL", "SETUSER", "default", "nopass")
+	runIn(session, "AUTH", "reader", "secret")
+	runIn(session, "RESET")
+	if session.User != "default" || !session.Authenticated {
+		t.Errorf("expected the default user to be authenticated, got %+v", session)
+	}
+}
+
+func TestSession(t *testing.T) {
+	ts := newTestServer(t)
+	session := ts.newSession(io.Discard)
+
+	if session.DB != 0 || session.Protocol != 2 || !session.Authenticated {
+		t.Errorf("unexpected initial session state: %+v", session)
+	}
+
+	// Commands from several pipelined requests are read one at a time from the same connection
+	input := encodeCommand("SET", "k", "v") + encodeCommand("GET", "k") + encodeCommand("DEL", "k") + encodeCommand("GET", "k")
+	reader := bufio.NewReader(strings.NewReader(input))
+	expected := []string{"+OK\r\n", "$1\r\nv\r\n", ":1\r\n", "$-1\r\n"}
+	for i, want := range expected {
+		if got, _ := session.ParseCommand(context.Background(), reader); got != want {
+			t.Errorf("command %d: expected %q, got %q", i, want, got)
+		}
+	}
+
+	// Sessions share the keyspace
+	runIn(session, "SET", "shared", "1")
+	if got := runIn(ts.newSession(io.Discard), "GET", "shared"); got != "$1\r\n1\r\n" {
+		t.Errorf("expected another session to see the key, got %q", got)
+	}
+}
+
+// mockStore is a backend serving GET and SET from a plain map,
+// any other method panics through the nil embedded interface
+type mockStore struct {
+	Store
+	data map[string]string
+}
+
+func (m *mockStore) Get(key string) (string, bool) {
+	val, ok := m.data[key]
+	return val, ok
+}
+
+func (m *mockStore) Set(key, value string) {
+	m.data[key] = value
+}
+
+func TestMockStore(t *testing.T) {
+	ts := newTestServer(t)
+	backend := &mockStore{data: map[string]string{"existing": "value"}}
+	session := NewSession(io.Discard, backend, ts.ttl, ts.repl, eviction.New(backend, ts.ttl), ts.users)
+
+	if got := runIn(session, "SET", "key", "new"); got != "+OK\r\n" {
+		t.Errorf("expected SET to succeed, got %q", got)
+	}
+	if backend.data["key"] != "new" {
+		t.Errorf("expected SET to write to the backend, got %q", backend.data)
+	}
+	if got := runIn(session, "GET", "existing"); got != "$5\r\nvalue\r\n" {
+		t.Errorf("expected GET to read from the backend, got %q", got)
+	}
+	if got := runIn(session, "GET", "missing"); got != "$-1\r\n" {
+		t.Errorf("expected GET of a missing key to be null, got %q", got)
+	}
+}
+
+func TestTakeSnapshot(t *testing.T) {
+	ts := newTestServer(t)
+	ts.run("MSET", "a", "1", "b", "2")
+	ts.run("EXPIRE", "a", "100")
+	snapshot := takeSnapshot(ts.store, ts.ttl)
+
+	ts.run("SET", "a", "changed")
+	ts.run("EXPIRE", "b", "100")
+	ts.run("FLUSHALL")
+
+	if len(snapshot.Data) != 2 || snapshot.Data["a"] != "1" || snapshot.Data["b"] != "2" {
+		t.Errorf("expected the keyspace copy to be unaffected by later writes, got %v", snapshot.Data)
+	}
+	if _, ok := snapshot.Expires["a"]; !ok || len(snapshot.Expires) != 1 {
+		t.Errorf("expected only the TTL of a, got %v", snapshot.Expires)
+	}
+}
+
+func TestIncr(t *testing.T) {
+	ts := newTestServer(t)
+	ts.run("MSET", "padded", "007", "text", "abc", "max", "9223372036854775807")
+	ts.run("SET", "volatile", "1")
+	ts.run("EXPIRE", "volatile", "100")
+	tests := []struct {
+		name     string
+		key      string
+		expected string
+	}{
+		{name: "missing key", key: "counter", expected: ":1\r\n"},
+		{name: "existing counter", key: "counter", expected: ":2\r\n"},
+		{name: "non-canonical integer", key: "padded", expected: "-ERR value is not an integer or out of range\r\n"},
+		{name: "not an integer", key: "text", expected: "-ERR value is not an integer or out of range\r\n"},
+		{name: "overflow", key: "max", expected: "-ERR increment or decrement would overflow\r\n"},
+		{name: "key with a TTL", key: "volatile", expected: ":2\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ts.run("INCR", tt.key); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+	if got := ts.run("TTL", "volatile"); got == ":-1\r\n" {
+		t.Errorf("expected INCR to keep the TTL, got %q", got)
+	}
+}
+
+func TestPing(t *testing.T) {
+	ts := newTestServer(t)
+	if got := ts.run("PING"); got != "+PONG\r\n" {
+		t.Errorf("expected +PONG, got %q", got)
+	}
+	if got := ts.run("PING", "hello"); got != "$5\r\nhello\r\n" {
+		t.Errorf("expected the message to be echoed, got %q", got)
+	}
+	if got := ts.run("PING", "a", "b"); got != "-ERR wrong number of arguments for 'ping' command\r\n" {
+		t.Errorf("expected an arity error, got %q", got)
+	}
+}
+
+// TestRedisBenchmarkStream replays a pipelined stream of the commands redis-benchmark sends
+// with its default options, the replies are the ones Redis gives byte for byte
+func TestRedisBenchmarkStream(t *testing.T) {
+	ts := newTestServer(t)
+	stream := "*1\r\n$4\r\nPING\r\n" +
+		"*3\r\n$3\r\nSET\r\n$16\r\nkey:__rand_int__\r\n$3\r\nxxx\r\n" +
+		"*2\r\n$3\r\nGET\r\n$16\r\nkey:__rand_int__\r\n" +
+		"*2\r\n$4\r\nINCR\r\n$20\r\ncounter:__rand_int__\r\n" +
+		"*2\r\n$4\r\nINCR\r\n$20\r\ncounter:__rand_int__\r\n" +
+		"*2\r\n$3\r\nGET\r\n$20\r\nmissing:__rand_int__\r\n"
+	expected := "+PONG\r\n" + "+OK\r\n" + "$3\r\nxxx\r\n" + ":1\r\n" + ":2\r\n" + "$-1\r\n"
+
+	reader := bufio.NewReader(strings.NewReader(stream))
+	var replies strings.Builder
+	for {
+		reply, closeConn := ts.session.ParseCommand(context.Background(), reader)
+		replies.WriteString(reply)
+		if closeConn {
+			break
+		}
+	}
+	if got := replies.String(); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestCommandGetKeys(t *testing.T) {
+	ts := newTestServer(t)
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{
+			name:     "MSET keys with step 2",
+			args:     []string{"COMMAND", "GETKEYS", "MSET", "a", "1", "b", "2"},
+			expected: EncodeArray([]string{"a", "b"}),
+		},
+		{
+			name:     "GET single key",
+			args:     []string{"COMMAND", "GETKEYS", "GET", "foo"},
+			expected: EncodeArray([]string{"foo"}),
+		},
+		{
+			name:     "lowercase command name",
+			args:     []string{"command", "getkeys", "set", "foo", "bar"},
+			expected: EncodeArray([]string{"foo"}),
+		},
+		{
+			name:     "command without keys",
+			args:     []string{"COMMAND", "GETKEYS", "PING"},
+			expected: EncodeError("ERR The command has no key arguments"),
+		},
+		{
+			name:     "pattern isn't a key",
+			args:     []string{"COMMAND", "GETKEYS", "KEYS", "*"},
+			expected: EncodeError("ERR The command has no key arguments"),
+		},
+		{
+			name:     "wrong number of arguments",
+			args:     []string{"COMMAND", "GETKEYS", "GET", "foo", "bar"},
+			expected: EncodeError("ERR Invalid number of arguments specified for command"),
+		},
+		{
+			name:     "wrong number of arguments for variadic command",
+			args:     []string{"COMMAND", "GETKEYS", "MSET", "a"},
+			expected: EncodeError("ERR Invalid number of arguments specified for command"),
+		},
+		{
+			name:     "unknown command",
+			args:     []string{"COMMAND", "GETKEYS", "NOPE", "foo"},
+			expected: EncodeError("ERR Invalid command specified"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ts.run(tt.args...); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestCommandClassification(t *testing.T) {
+	tests := []struct {
+		cmd      string
+		write    bool
+		readOnly bool
+	}{
+		{cmd: "SET", write: true},
+		{cmd: "set", write: true},
+		{cmd: "GET", readOnly: true},
+		{cmd: "KEYS", readOnly: true},
+		{cmd: "CONFIG"},
+		{cmd: "NOPE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cmd, func(t *testing.T) {
+			if got := IsWrite(tt.cmd); got != tt.write {
+				t.Errorf("expected IsWrite to be %v, got %v", tt.write, got)
+			}
+			if got := IsReadOnly(tt.cmd); got != tt.readOnly {
+				t.Errorf("expected IsReadOnly to be %v, got %v", tt.readOnly, got)
+			}
+		})
+	}
+
+	// COMMAND reports the same flags
+	reply := newTestServer(t).run("COMMAND")
+	for _, expected := range []string{
+		EncodeArrayMixed([]interface{}{"SET", int64(-3), []string{"write", "denyoom"}, int64(1), int64(1), int64(1)}),
+		EncodeArrayMixed([]interface{}{"GET", int64(2), []string{"readonly"}, int64(1), int64(1), int64(1)}),
+	} {
+		if !strings.Contains(reply, expected) {
+			t.Errorf("expected COMMAND to contain %q", expected)
+		}
+	}
+}
+
+func TestCommandList(t *testing.T) {
+	ts := newTestServer(t)
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{name: "pattern", args: []string{"COMMAND", "LIST", "FILTERBY", "PATTERN", "get*"}, expected: EncodeArray([]string{"get", "getrange"})},
+		{name: "pattern ignores case", args: []string{"COMMAND", "LIST", "FILTERBY", "PATTERN", "*SETEX"}, expected: EncodeArray([]string{"psetex", "setex"})},
+		{name: "acl category", args: []string{"command", "list", "filterby", "aclcat", "@admin"}, expected: EncodeArray([]string{"acl", "client", "config", "debug", "failover", "replicaof", "slaveof", "sync"})},
+		{name: "unknown acl category", args: []string{"COMMAND", "LIST", "FILTERBY", "ACLCAT", "nope"}, expected: "*0\r\n"},
+		{name: "module", args: []string{"COMMAND", "LIST", "FILTERBY", "MODULE", "json"}, expected: "*0\r\n"},
+		{name: "unknown filter", args: []string{"COMMAND", "LIST", "FILTERBY", "NOPE", "x"}, expected: "-ERR syntax error\r\n"},
+		{name: "missing filter value", args: []string{"COMMAND", "LIST", "FILTERBY", "PATTERN"}, expected: "-ERR syntax error\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ts.run(tt.args...); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+
+	all := ts.run("COMMAND", "LIST")
+	if !strings.HasPrefix(all, "*"+strconv.Itoa(len(commands()))+"\r\n") || !strings.Contains(all, "$3\r\nset\r\n") {
+		t.Errorf("expected all the commands, got %q", all)
+	}
+	write := ts.run("COMMAND", "LIST", "FILTERBY", "ACLCAT", "write")
+	read := ts.run("COMMAND", "LIST", "FILTERBY", "ACLCAT", "read")
+	if !strings.Contains(write, "$3\r\nset\r\n") || strings.Contains(write, "$3\r\nget\r\n") || !strings.Contains(read, "$3\r\nget\r\n") {
+		t.Errorf("expected SET in @write and GET in @read, got %q and %q", write, read)
+	}
+}
+
+func TestRegisterCommand(t *testing.T) {
+	Register(Command{
+		Name:     "upper",
+		Arity:    2,
+		Flags:    []string{"readonly"},
+		FirstKey: 1,
+		LastKey:  1,
+		Step:     1,
+		Handler: func(s *Session, args []string) string {
+			val, _ := s.lookupRead(args[0])
+			val = strings.ToUpper(val)
+			return EncodeBulkString(&val)
+		},
+	})
+	t.Cleanup(func() {
+		registryMu.Lock()
+		delete(registry, "UPPER")
+		registryMu.Unlock()
+	})
+
+	ts := newTestServer(t)
+	ts.run("SET", "key", "value")
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{name: "custom command runs", args: []string{"UPPER", "key"}, expected: "$5\r\nVALUE\r\n"},
+		{name: "arity is checked", args: []string{"upper"}, expected: "-ERR wrong number of arguments for 'upper' command\r\n"},
+		{name: "keys are known", args: []string{"COMMAND", "GETKEYS", "UPPER", "key"}, expected: EncodeArray([]string{"key"})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ts.run(tt.args...); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+	if got := ts.run("COMMAND"); !strings.Contains(got, "$5\r\nUPPER\r\n") {
+		t.Errorf("expected COMMAND to list the custom command, got %q", got)
+	}
+}
+
+func TestMSet(t *testing.T) {
+	ts := newTestServer(t)
+
+	if got := ts.run("MSET", "a", "1", "b", "2", "a", "3"); got != "+OK\r\n" {
+		t.Fatalf("expected OK, got %q", got)
+	}
+	if got := ts.run("GET", "a"); got != "$1\r\n3\r\n" {
+		t.Errorf("expected the last value to win, got %q", got)
+	}
+	if got := ts.run("GET", "b"); got != "$1\r\n2\r\n" {
+		t.Errorf("expected b=2, got %q", got)
+	}
+	if got := ts.run("MSET", "a", "1", "b"); !strings.HasPrefix(got, "-ERR") {
+		t.Errorf("expected an error for odd number of arguments, got %q", got)
+	}
+}
+
+func TestDel(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{name: "single key", args: []string{"DEL", "a"}, expected: ":1\r\n"},
+		{name: "several keys", args: []string{"DEL", "a", "b", "volatile"}, expected: ":3\r\n"},
+		{name: "missing keys are not counted", args: []string{"DEL", "a", "missing"}, expected: ":1\r\n"},
+		{name: "repeated key is counted once", args: []string{"DEL", "a", "a"}, expected: ":1\r\n"},
+		{name: "unlink", args: []string{"UNLINK", "a", "b", "missing"}, expected: ":2\r\n"},
+		{name: "no key", args: []string{"DEL"}, expected: "-ERR wrong number of arguments for 'del' command\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			ts.run("MSET", "a", "1", "b", "2", "volatile", "3")
+			ts.run("EXPIRE", "volatile", "100")
+			if got := ts.run(tt.args...); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+			for _, key := range tt.args[1:] {
+				if _, ok := ts.store.Get(key); ok {
+					t.Errorf("expected %s to be deleted", key)
+				}
+				if _, ok := ts.ttl.GetTTL(key); ok {
+					t.Errorf("expected the TTL of %s to be removed", key)
+				}
+			}
+		})
+	}
+}
+
+func TestMSetNX(t *testing.T) {
+	ts := newTestServer(t)
+
+	if got := ts.run("MSETNX", "a", "1", "b", "2"); got != ":1\r\n" {
+		t.Fatalf("expected all keys to be set, got %q", got)
+	}
+	// One existing key makes the whole command a no-op
+	if got := ts.run("MSETNX", "c", "3", "a", "4"); got != ":0\r\n" {
+		t.Errorf("expected nothing to be set, got %q", got)
+	}
+	if got := ts.run("GET", "a"); got != "$1\r\n1\r\n" {
+		t.Errorf("expected a to keep its value, got %q", got)
+	}
+	if got := ts.run("GET", "c"); got != "$-1\r\n" {
+		t.Errorf("expected c not to be set, got %q", got)
+	}
+	if got := ts.run("MSETNX", "c", "3", "d"); !strings.HasPrefix(got, "-ERR") {
+		t.Errorf("expected an error for odd number of arguments, got %q", got)
+	}
+}
+
+func TestKeysCancelled(t *testing.T) {
+	ts := newTestServer(t)
+	ts.run("MSET", "k1", "v1", "k2", "v2")
+
+	if got := ts.run("KEYS", "k1"); got != EncodeArray([]string{"k1"}) {
+		t.Fatalf("expected KEYS to find k1, got %q", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	expected := EncodeError("ERR KEYS aborted: context canceled")
+	if got := runInContext(ctx, ts.session, "KEYS", "*"); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestMetricsScrape(t *testing.T) {
+	previous := metrics.Default()
+	t.Cleanup(func() { metrics.SetDefault(previous) })
+	metrics.SetDefault(metrics.NewCollector())
+
+	ts := newTestServer(t)
+	ts.run("SET", "k", "v")
+	ts.run("GET", "k")
+	ts.run("GET", "missing")
+	ts.run("NOSUCHCOMMAND")
+
+	srv := httptest.NewServer(metrics.Default().Handler())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("failed to scrape metrics: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, _ := io.ReadAll(resp.Body)
+
+	for _, line := range []string{
+		"goradieschen_commands_processed_total 3\n",
+		`goradieschen_commands_total{command="get"} 2` + "\n",
+		`goradieschen_commands_total{command="set"} 1` + "\n",
+		"goradieschen_keyspace_hits_total 1\n",
+		"goradieschen_keyspace_misses_total 1\n",
+	} {
+		if !strings.Contains(string(body), line) {
+			t.Errorf("expected metrics to contain %q, got:\n%s", line, body)
+		}
+	}
+	if strings.Contains(string(body), "nosuchcommand") {
+		t.Errorf("expected unknown commands not to be tracked, got:\n%s", body)
+	}
+}
+
+func TestKeyspaceHitsAndMisses(t *testing.T) {
+	previous := metrics.Default()
+	t.Cleanup(func() { metrics.SetDefault(previous) })
+
+	tests := []struct {
+		name           string
+		args           []string
+		expectedHits   int64
+		expectedMisses int64
+	}{
+		{name: "GET on a present key is a hit", args: []string{"GET", "present"}, expectedHits: 1},
+		{name: "GET on an absent key is a miss", args: []string{"GET", "absent"}, expectedMisses: 1},
+		{name: "TTL on a present key is a hit", args: []string{"TTL", "present"}, expectedHits: 1},
+		{name: "TTL on an absent key is a miss", args: []string{"TTL", "absent"}, expectedMisses: 1},
+		{name: "writes are neither hits nor misses", args: []string{"SET", "present", "v2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			ts.run("SET", "present", "v")
+			stats := metrics.NewCollector()
+			metrics.SetDefault(stats)
+
+			ts.run(tt.args...)
+			if got := stats.KeyspaceHits(); got != tt.expectedHits {
+				t.Errorf("expected %d hits, got %d", tt.expectedHits, got)
+			}
+			if got := stats.KeyspaceMisses(); got != tt.expectedMisses {
+				t.Errorf("expected %d misses, got %d", tt.expectedMisses, got)
+			}
+
+			reply := ts.run("INFO", "stats")
+			for _, line := range []string{
+				"keyspace_hits:" + strconv.FormatInt(tt.expectedHits, 10) + "\r\n",
+				"keyspace_misses:" + strconv.FormatInt(tt.expectedMisses, 10) + "\r\n",
+			} {
+				if !strings.Contains(reply, line) {
+					t.Errorf("expected INFO stats to contain %q, got %q", line, reply)
+				}
+			}
+		})
+	}
+}
+
+func TestInfoCommandStats(t *testing.T) {
+	previous := metrics.Default()
+	t.Cleanup(func() { metrics.SetDefault(previous) })
+	metrics.SetDefault(metrics.NewCollector())
+
+	ts := newTestServer(t)
+	ts.run("SET", "k", "v")
+	for i := 1; i <= 3; i++ {
+		ts.run("GET", "k")
+		reply := ts.run("INFO", "commandstats")
+		prefix := "cmdstat_get:calls=" + strconv.Itoa(i) + ",usec="
+		if !strings.Contains(reply, prefix) {
+			t.Errorf("expected INFO commandstats to contain %q, got %q", prefix, reply)
+		}
+	}
+
+	reply := ts.run("INFO", "commandstats")
+	if !strings.HasPrefix(reply, "$") || !strings.Contains(reply, "# Commandstats\r\n") {
+		t.Errorf("expected a commandstats bulk string, got %q", reply)
+	}
+	if !strings.Contains(reply, "cmdstat_set:calls=1,") {
+		t.Errorf("expected SET to be reported once, got %q", reply)
+	}
+	if !strings.Contains(reply, "cmdstat_info:calls=3,") {
+		t.Errorf("expected previous INFO calls to be reported, got %q", reply)
+	}
+}
+
+func TestHelpSubcommand(t *testing.T) {
+	ts := newTestServer(t)
+	for _, name := range []string{"ACL", "OBJECT", "CLIENT", "CLUSTER", "CONFIG", "COMMAND", "DEBUG", "MEMORY"} {
+		t.Run(name, func(t *testing.T) {
+			// The help is an array of bulk strings, which decodes the same way as a command
+			first, rest, err := DecodeCommand(bufio.NewReader(strings.NewReader(ts.run(name, "help"))))
+			if err != nil {
+				t.Fatalf("expected an array reply, got error: %v", err)
+			}
+			if !strings.HasPrefix(first, name+" <subcommand>") || len(rest) == 0 {
+				t.Errorf("expected a %s usage line followed by the subcommands, got %q, %q", name, first, rest)
+			}
+		})
+	}
+}
+
+func TestConfigResetStat(t *testing.T) {
+	previous := metrics.Default()
+	t.Cleanup(func() { metrics.SetDefault(previous) })
+	stats := metrics.NewCollector()
+	metrics.SetDefault(stats)
+
+	ts := newTestServer(t)
+	ts.run("SET", "k", "v")
+	ts.run("GET", "k")
+	ts.run("GET", "missing")
+	if stats.CommandsProcessed() == 0 || stats.KeyspaceHits() == 0 || stats.KeyspaceMisses() == 0 {
+		t.Fatal("expected non-zero stats before the reset")
+	}
+
+	if got := ts.run("CONFIG", "RESETSTAT"); got != "+OK\r\n" {
+		t.Fatalf("expected OK, got %q", got)
+	}
+
+	// The CONFIG RESETSTAT call is recorded after the reset
+	if got := stats.CommandsProcessed(); got != 1 {
+		t.Errorf("expected only CONFIG to be counted after the reset, got %d", got)
+	}
+	if stats.KeyspaceHits() != 0 || stats.KeyspaceMisses() != 0 {
+		t.Errorf("expected keyspace stats to be zeroed, got hits=%d misses=%d", stats.KeyspaceHits(), stats.KeyspaceMisses())
+	}
+	reply := ts.run("INFO", "commandstats")
+	if strings.Contains(reply, "cmdstat_get") || strings.Contains(reply, "cmdstat_set") {
+		t.Errorf("expected commandstats to be cleared, got %q", reply)
+	}
+
+	if got := ts.run("CONFIG", "NOPE"); got != "-ERR unknown subcommand 'NOPE'\r\n" {
+		t.Errorf("expected unknown subcommand error, got %q", got)
+	}
+}
+
+func TestObjectRefCount(t *testing.T) {
+	ts := newTestServer(t)
+	ts.run("MSET", "int", "42", "bigint", "10000", "padded", "007", "negative", "-1", "str", "hello")
+
+	tests := []struct {
+		name     string
+		key      string
+		expected string
+	}{
+		{name: "small integer is shared", key: "int", expected: ":2147483647\r\n"},
+		{name: "integer above the shared range", key: "bigint", expected: ":1\r\n"},
+		{name: "non-canonical integer", key: "padded", expected: ":1\r\n"},
+		{name: "negative integer", key: "negative", expected: ":1\r\n"},
+		{name: "string value", key: "str", expected: ":1\r\n"},
+		{name: "missing key", key: "missing", expected: "-ERR no such key\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ts.run("OBJECT", "REFCOUNT", tt.key); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestObjectEncoding(t *testing.T) {
+	ts := newTestServer(t)
+	ts.run("MSET", "int", "-42", "padded", "007", "short", "hello", "long", strings.Repeat("x", 45))
+	tests := []struct {
+		key      string
+		expected string
+	}{
+		{key: "int", expected: "$3\r\nint\r\n"},
+		{key: "padded", expected: "$6\r\nembstr\r\n"},
+		{key: "short", expected: "$6\r\nembstr\r\n"},
+		{key: "long", expected: "$3\r\nraw\r\n"},
+		{key: "missing", expected: "$-1\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := ts.run("OBJECT", "ENCODING", tt.key); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestObjectEncodingModifiedInPlace(t *testing.T) {
+	ts := newTestServer(t)
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{name: "set integer", args: []string{"SET", "n", "100"}, expected: "int"},
+		{name: "append downgrades to raw", args: []string{"APPEND", "n", "x"}, expected: "raw"},
+		{name: "set re-encodes", args: []string{"SET", "n", "100"}, expected: "int"},
+		{name: "setrange downgrades to raw", args: []string{"SETRANGE", "n", "0", "5"}, expected: "raw"},
+		{name: "incr encodes as integer", args: []string{"INCR", "n"}, expected: "int"},
+		{name: "append on missing key", args: []string{"APPEND", "new", "1"}, expected: "raw"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts.run(tt.args...)
+			if got := ts.run("OBJECT", "ENCODING", tt.args[1]); got != EncodeBulkString(&tt.expected) {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+			if got := ts.run("DEBUG", "OBJECT", tt.args[1]); !strings.Contains(got, "encoding:"+tt.expected+" ") {
+				t.Errorf("expected DEBUG OBJECT to report %q, got %q", tt.expected, got)
+			}
+		})
+	}
+	// The value is kept exactly as written
+	if got := ts.run("GET", "n"); got != "$3\r\n501\r\n" {
+		t.Errorf("expected 501, got %q", got)
+	}
+	ts.run("SETRANGE", "n", "0", "1")
+	if got := ts.run("OBJECT", "REFCOUNT", "n"); got != ":1\r\n" {
+		t.Errorf("expected a raw value not to be shared, got %q", got)
+	}
+}
+
+func TestClientNoTouch(t *testing.T) {
+	ts := newTestServer(t)
+	ts.run("SET", "key", "value")
+	time.Sleep(1100 * time.Millisecond)
+
+	if got := ts.run("CLIENT", "NO-TOUCH", "ON"); got != "+OK\r\n" {
+		t.Fatalf("expected OK, got %q", got)
+	}
+	ts.run("GET", "key")
+	if got := ts.run("OBJECT", "IDLETIME", "key"); got != ":1\r\n" {
+		t.Errorf("expected GET not to bump the idle time with NO-TOUCH ON, got %q", got)
+	}
+
+	ts.run("CLIENT", "NO-TOUCH", "OFF")
+	ts.run("GET", "key")
+	if got := ts.run("OBJECT", "IDLETIME", "key"); got != ":0\r\n" {
+		t.Errorf("expected GET to reset the idle time with NO-TOUCH OFF, got %q", got)
+	}
+}
+
+func TestClientFlags(t *testing.T) {
+	ts := newTestServer(t)
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{name: "no-evict on", args: []string{"CLIENT", "NO-EVICT", "ON"}, expected: "+OK\r\n"},
+		{name: "no-evict off", args: []string{"CLIENT", "no-evict", "off"}, expected: "+OK\r\n"},
+		{name: "invalid value", args: []string{"CLIENT", "NO-TOUCH", "MAYBE"}, expected: "-ERR syntax error\r\n"},
+		{name: "missing value", args: []string{"CLIENT", "NO-EVICT"}, expected: "-ERR usage: CLIENT NO-EVICT ON|OFF\r\n"},
+		{name: "unknown subcommand", args: []string{"CLIENT", "NOPE"}, expected: "-ERR unknown subcommand 'NOPE'\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ts.run(tt.args...); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+	ts.run("CLIENT", "NO-EVICT", "ON")
+	if !ts.session.NoEvict {
+		t.Error("expected the session to be flagged as no-evict")
+	}
+}
+
+func TestClientInfo(t *testing.T) {
+	ts := newTestServer(t)
+	ts.run("SET", "key", "value")
+	ts.run("GET", "key")
+	ts.run("NOPE")
+	ts.run("CLIENT", "NO-TOUCH", "ON")
+
+	got := ts.run("CLIENT", "INFO")
+	// Unknown commands aren't counted, CLIENT INFO itself is
+	for _, field := range []string{" flags=T ", " db=0 ", " tot-cmds=4 ", " cmd=client\n"} {
+		if !strings.Contains(got, field) {
+			t.Errorf("expected CLIENT INFO to contain %q, got %q", field, got)
+		}
+	}
+
+	other := runIn(ts.newSession(io.Discard), "CLIENT", "INFO")
+	// The first field after the bulk string length is the client id
+	if !strings.Contains(other, " tot-cmds=1 ") || strings.Fields(other)[1] == strings.Fields(got)[1] {
+		t.Errorf("expected another session to be counted separately, got %q and %q", got, other)
+	}
+}
+
+func TestVolatileEviction(t *testing.T) {
+	oomErr := EncodeError("OOM command not allowed when used memory > 'maxmemory'.")
+
+	t.Run("noeviction rejects writes over the limit", func(t *testing.T) {
+		ts := newTestServer(t)
+		ts.evict.SetMaxMemory(10)
+		ts.run("SET", "key", "a long enough value")
+		if got := ts.run("SET", "other", "value"); got != oomErr {
+			t.Errorf("expected %q, got %q", oomErr, got)
+		}
+		if got := ts.run("DEL", "key"); got != ":1\r\n" {
+			t.Errorf("expected DEL to be allowed over the limit, got %q", got)
+		}
+	})
+
+	t.Run("volatile-random never evicts keys without a TTL", func(t *testing.T) {
+		ts := newTestServer(t)
+		ts.evict.SetPolicy(eviction.VolatileRandom)
+		ts.run("SET", "persistent", "value")
+		for i := 0; i < 5; i++ {
+			key := "volatile:" + strconv.Itoa(i)
+			ts.run("SET", key, "value")
+			ts.run("EXPIRE", key, "100")
+		}
+		ts.evict.SetMaxMemory(ts.store.UsedMemory() - 1)
+
+		if got := ts.run("SET", "new", "value"); got != "+OK\r\n" {
+			t.Fatalf("expected a volatile key to be evicted, got %q", got)
+		}
+		if _, ok := ts.store.Get("persistent"); !ok {
+			t.Errorf("expected the key without a TTL to be kept")
+		}
+
+		// Only keys without a TTL are left once the limit is lowered below them
+		ts.evict.SetMaxMemory(1)
+		if got := ts.run("SET", "another", "value"); got != oomErr {
+			t.Errorf("expected %q, got %q", oomErr, got)
+		}
+		if _, ok := ts.store.Get("persistent"); !ok {
+			t.Errorf("expected the key without a TTL to be kept")
+		}
+		if keys := ts.ttl.Sample(1); keys != nil {
+			t.Errorf("expected all volatile keys to be evicted, got %v", keys)
+		}
+	})
+
+	t.Run("volatile-ttl evicts the key closest to expiring", func(t *testing.T) {
+		ts := newTestServer(t)
+		ts.evict.SetPolicy(eviction.VolatileTTL)
+		ts.run("MSET", "soon", "value", "later", "value")
+		ts.run("EXPIRE", "soon", "10")
+		ts.run("EXPIRE", "later", "100")
+		ts.evict.SetMaxMemory(ts.store.UsedMemory() - 1)
+
+		if got := ts.run("SET", "new", "value"); got != "+OK\r\n" {
+			t.Fatalf("expected %q, got %q", "+OK\r\n", got)
+		}
+		if _, ok := ts.store.Get("soon"); ok {
+			t.Errorf("expected the key closest to expiring to be evicted")
+		}
+		if _, ok := ts.store.Get("later"); !ok {
+			t.Errorf("expected the key expiring later to be kept")
+		}
+	})
+}
+
+func TestLCS(t *testing.T) {
+	ts := newTestServer(t)
+	ts.run("MSET", "key1", "ohmytext", "key2", "mynewtext")
+
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{name: "subsequence", args: []string{"LCS", "key1", "key2"}, expected: "$6\r\nmytext\r\n"},
+		{name: "length", args: []string{"LCS", "key1", "key2", "LEN"}, expected: ":6\r\n"},
+		{
+			name: "indexes",
+			args: []string{"LCS", "key1", "key2", "IDX"},
+			expected: "*4\r\n$7\r\nmatches\r\n*2\r\n" +
+				"*2\r\n*2\r\n:4\r\n:7\r\n*2\r\n:5\r\n:8\r\n" +
+				"*2\r\n*2\r\n:2\r\n:3\r\n*2\r\n:0\r\n:1\r\n" +
+				"$3\r\nlen\r\n:6\r\n",
+		},
+		{
+			name: "indexes with match length filter",
+			args: []string{"LCS", "key1", "key2", "IDX", "MINMATCHLEN", "4", "WITHMATCHLEN"},
+			expected: "*4\r\n$7\r\nmatches\r\n*1\r\n" +
+				"*3\r\n*2\r\n:4\r\n:7\r\n*2\r\n:5\r\n:8\r\n:4\r\n" +
+				"$3\r\nlen\r\n:6\r\n",
+		},
+		{name: "missing key is an empty string", args: []string{"LCS", "key1", "missing"}, expected: "$0\r\n\r\n"},
+		{
+			name:     "length and indexes",
+			args:     []string{"LCS", "key1", "key2", "LEN", "IDX"},
+			expected: "-ERR If you want both the length and indexes, please just use IDX.\r\n",
+		},
+		{name: "unknown option", args: []string{"LCS", "key1", "key2", "FOO"}, expected: "-ERR syntax error\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ts.run(tt.args...); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestGetRange(t *testing.T) {
+	ts := newTestServer(t)
+	ts.run("SET", "key", "This is a string")
+
+	tests := []struct {
+		name       string
+		key        string
+		start, end string
+		expected   string
+	}{
+		{name: "prefix", key: "key", start: "0", end: "3", expected: "This"},
+		{name: "negative offsets", key: "key", start: "-3", end: "-1", expected: "ing"},
+		{name: "whole string", key: "key", start: "0", end: "-1", expected: "This is a string"},
+		{name: "end beyond length", key: "key", start: "10", end: "100", expected: "string"},
+		{name: "negative start beyond length", key: "key", start: "-100", end: "3", expected: "This"},
+		{name: "start after end", key: "key", start: "5", end: "3", expected: ""},
+		{name: "negative start after negative end", key: "key", start: "-1", end: "-5", expected: ""},
+		{name: "start beyond length", key: "key", start: "100", end: "200", expected: ""},
+		{name: "negative end beyond length", key: "key", start: "0", end: "-100", expected: "T"},
+		{name: "missing key", key: "missing", start: "0", end: "-1", expected: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expected := EncodeBulkString(&tt.expected)
+			if got := ts.run("GETRANGE", tt.key, tt.start, tt.end); got != expected {
+				t.Errorf("expected %q, got %q", expected, got)
+			}
+		})
+	}
+}
+
+func TestSubstr(t *testing.T) {
+	ts := newTestServer(t)
+	ts.run("SET", "key", "This is a string")
+
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{name: "prefix", args: []string{"key", "0", "3"}},
+		{name: "negative offsets", args: []string{"key", "-3", "-1"}},
+		{name: "negative start beyond length", args: []string{"key", "-100", "3"}},
+		{name: "negative end beyond length", args: []string{"key", "0", "-100"}},
+		{name: "negative start after negative end", args: []string{"key", "-1", "-5"}},
+		{name: "start beyond length", args: []string{"key", "100", "200"}},
+		{name: "missing key", args: []string{"missing", "0", "-1"}},
+		{name: "invalid offset", args: []string{"key", "a", "1"}},
+		{name: "wrong number of arguments", args: []string{"key", "0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expected := ts.run(append([]string{"GETRANGE"}, tt.args...)...)
+			got := ts.run(append([]string{"SUBSTR"}, tt.args...)...)
+			// The arity error names the command it was called as
+			expected = strings.Replace(expected, "'getrange'", "'substr'", 1)
+			if got != expected {
+				t.Errorf("expected %q, got %q", expected, got)
+			}
+		})
+	}
+}
+
+func TestSetRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		initial  *string
+		offset   string
+		value    string
+		reply    string
+		expected *string
+	}{
+		{name: "overwrite", initial: stringPtr("Hello World"), offset: "6", value: "Redis", reply: ":11\r\n", expected: stringPtr("Hello Redis")},
+		{name: "extend", initial: stringPtr("Hello"), offset: "3", value: "p me", reply: ":7\r\n", expected: stringPtr("Help me")},
+		{name: "pad missing key", offset: "3", value: "abc", reply: ":6\r\n", expected: stringPtr("\x00\x00\x00abc")},
+		{name: "pad existing key", initial: stringPtr("ab"), offset: "4", value: "c", reply: ":5\r\n", expected: stringPtr("ab\x00\x00c")},
+		{name: "empty value on missing key", offset: "10", value: "", reply: ":0\r\n"},
+		{name: "empty value on existing key", initial: stringPtr("Hello"), offset: "10", value: "", reply: ":5\r\n", expected: stringPtr("Hello")},
+		{name: "negative offset", initial: stringPtr("Hello"), offset: "-1", value: "x", reply: "-ERR offset is out of range\r\n", expected: stringPtr("Hello")},
+		{name: "offset too large", offset: "536870912", value: "x", reply: "-ERR string exceeds maximum allowed size (proto-max-bulk-len)\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			if tt.initial != nil {
+				ts.run("SET", "key", *tt.initial)
+			}
+			if got := ts.run("SETRANGE", "key", tt.offset, tt.value); got != tt.reply {
+				t.Errorf("expected %q, got %q", tt.reply, got)
+			}
+			val, ok := ts.store.Get("key")
+			if tt.expected == nil {
+				if ok {
+					t.Errorf("expected the key not to exist, got %q", val)
+				}
+				return
+			}
+			if !ok || val != *tt.expected {
+				t.Errorf("expected %q, got %q (exists: %v)", *tt.expected, val, ok)
+			}
+		})
+	}
+}
+
+func TestAppend(t *testing.T) {
+	ts := newTestServer(t)
+	ts.run("SET", "volatile", "a")
+	ts.run("EXPIRE", "volatile", "100")
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{name: "missing key", args: []string{"APPEND", "key", "Hello"}, expected: ":5\r\n"},
+		{name: "existing key", args: []string{"APPEND", "key", " World"}, expected: ":11\r\n"},
+		{name: "strlen", args: []string{"STRLEN", "key"}, expected: ":11\r\n"},
+		{name: "strlen of missing key", args: []string{"STRLEN", "missing"}, expected: ":0\r\n"},
+		{name: "append keeps the ttl", args: []string{"APPEND", "volatile", "b"}, expected: ":2\r\n"},
+		{name: "ttl", args: []string{"TTL", "volatile"}, expected: ":100\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ts.run(tt.args...); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+
+	defer SetProtoMaxBulkLen(ProtoMaxBulkLen())
+	SetProtoMaxBulkLen(16)
+	if got := ts.run("APPEND", "key", "123456"); got != "-ERR string exceeds maximum allowed size (proto-max-bulk-len)\r\n" {
+		t.Errorf("expected the size limit to be enforced, got %q", got)
+	}
+	if got := ts.run("GET", "key"); got != "$11\r\nHello World\r\n" {
+		t.Errorf("expected the appended value, got %q", got)
+	}
+}
+
+func TestBinarySafeStrings(t *testing.T) {
+	ts := newTestServer(t)
+	// A zero byte, bytes that aren't valid UTF-8 and a multi-byte UTF-8 character
+	value := "a\x00\xff\xfeé"
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{name: "set", args: []string{"SET", "key", value}, expected: "+OK\r\n"},
+		{name: "get", args: []string{"GET", "key"}, expected: "$6\r\n" + value + "\r\n"},
+		{name: "strlen counts bytes", args: []string{"STRLEN", "key"}, expected: ":6\r\n"},
+		{name: "getrange slices bytes", args: []string{"GETRANGE", "key", "1", "2"}, expected: "$2\r\n\x00\xff\r\n"},
+		{name: "getrange splits characters", args: []string{"GETRANGE", "key", "-1", "-1"}, expected: "$1\r\n\xa9\r\n"},
+		{name: "append concatenates bytes", args: []string{"APPEND", "key", "\x00\x80"}, expected: ":8\r\n"},
+		{name: "get after append", args: []string{"GET", "key"}, expected: "$8\r\n" + value + "\x00\x80\r\n"},
+		{name: "binary key", args: []string{"SET", "\xff\x00", "v"}, expected: "+OK\r\n"},
+		{name: "get binary key", args: []string{"GET", "\xff\x00"}, expected: "$1\r\nv\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ts.run(tt.args...); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestBitOp(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		reply    string
+		expected string
+	}{
+		{name: "xor", args: []string{"BITOP", "XOR", "dest", "a", "b"}, reply: ":2\r\n", expected: "\x0f\xff"},
+		{name: "and pads with zero bytes", args: []string{"BITOP", "AND", "dest", "a", "b"}, reply: ":2\r\n", expected: "\xf0\x00"},
+		{name: "or", args: []string{"BITOP", "OR", "dest", "a", "b"}, reply: ":2\r\n", expected: "\xff\xff"},
+		{name: "not", args: []string{"BITOP", "NOT", "dest", "a"}, reply: ":1\r\n", expected: "\x0f"},
+		{name: "missing keys", args: []string{"BITOP", "OR", "dest", "missing"}, reply: ":0\r\n"},
+		{name: "not with many keys", args: []string{"BITOP", "NOT", "dest", "a", "b"}, reply: "-ERR BITOP NOT must be called with a single source key.\r\n"},
+		{name: "unknown operation", args: []string{"BITOP", "NAND", "dest", "a", "b"}, reply: "-ERR syntax error\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			ts.run("MSET", "a", "\xf0", "b", "\xff\xff")
+			if got := ts.run(tt.args...); got != tt.reply {
+				t.Errorf("expected %q, got %q", tt.reply, got)
+			}
+			if val, _ := ts.store.Get("dest"); val != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, val)
+			}
+		})
+	}
+}
+
+func TestBitPos(t *testing.T) {
+	ts := newTestServer(t)
+	ts.run("MSET", "key", "\xff\xf0\x00", "ones", "\xff\xff", "zeros", "\x00\x00")
+
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{name: "first set bit", args: []string{"zeros", "1"}, expected: ":-1\r\n"},
+		{name: "first set bit in range", args: []string{"key", "1", "1"}, expected: ":8\r\n"},
+		{name: "first clear bit", args: []string{"key", "0"}, expected: ":12\r\n"},
+		{name: "clear bit past the end", args: []string{"ones", "0"}, expected: ":16\r\n"},
+		{name: "clear bit with explicit end", args: []string{"ones", "0", "0", "-1"}, expected: ":-1\r\n"},
+		{name: "negative range", args: []string{"key", "0", "-2", "-1"}, expected: ":12\r\n"},
+		{name: "bit range", args: []string{"key", "1", "2", "-1", "BIT"}, expected: ":2\r\n"},
+		{name: "start after end", args: []string{"key", "1", "2", "1"}, expected: ":-1\r\n"},
+		{name: "missing key set bit", args: []string{"missing", "1"}, expected: ":-1\r\n"},
+		{name: "missing key clear bit", args: []string{"missing", "0"}, expected: ":0\r\n"},
+		{name: "invalid bit", args: []string{"key", "2"}, expected: "-ERR The bit argument must be 1 or 0.\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ts.run(append([]string{"BITPOS"}, tt.args...)...); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestHyperLogLog(t *testing.T) {
+	ts := newTestServer(t)
+	ts.run("SET", "string", "value")
+	ts.run("PFADD", "volatile", "a")
+	ts.run("EXPIRE", "volatile", "100")
+
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{name: "add to missing key", args: []string{"PFADD", "hll", "a", "b", "c"}, expected: ":1\r\n"},
+		{name: "add existing elements", args: []string{"PFADD", "hll", "a", "b"}, expected: ":0\r\n"},
+		{name: "add without elements to existing key", args: []string{"PFADD", "hll"}, expected: ":0\r\n"},
+		{name: "add without elements to missing key", args: []string{"PFADD", "empty"}, expected: ":1\r\n"},
+		{name: "count", args: []string{"PFCOUNT", "hll"}, expected: ":3\r\n"},
+		{name: "count empty", args: []string{"PFCOUNT", "empty"}, expected: ":0\r\n"},
+		{name: "count missing key", args: []string{"PFCOUNT", "missing"}, expected: ":0\r\n"},
+		{name: "add to second key", args: []string{"PFADD", "other", "c", "d"}, expected: ":1\r\n"},
+		{name: "count union", args: []string{"PFCOUNT", "hll", "other", "missing"}, expected: ":4\r\n"},
+		{name: "merge", args: []string{"PFMERGE", "merged", "hll", "other"}, expected: "+OK\r\n"},
+		{name: "count merged", args: []string{"PFCOUNT", "merged"}, expected: ":4\r\n"},
+		{name: "merge into existing destination", args: []string{"PFMERGE", "hll", "other"}, expected: "+OK\r\n"},
+		{name: "count destination", args: []string{"PFCOUNT", "hll"}, expected: ":4\r\n"},
+		{name: "add keeps the ttl", args: []string{"PFADD", "volatile", "b"}, expected: ":1\r\n"},
+		{name: "ttl", args: []string{"TTL", "volatile"}, expected: ":100\r\n"},
+		{name: "encoding", args: []string{"OBJECT", "ENCODING", "hll"}, expected: "$3\r\nraw\r\n"},
+		{name: "add to string", args: []string{"PFADD", "string", "a"}, expected: "-WRONGTYPE Key is not a valid HyperLogLog string value.\r\n"},
+		{name: "count string", args: []string{"PFCOUNT", "hll", "string"}, expected: "-WRONGTYPE Key is not a valid HyperLogLog string value.\r\n"},
+		{name: "merge string", args: []string{"PFMERGE", "merged", "string"}, expected: "-WRONGTYPE Key is not a valid HyperLogLog string value.\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ts.run(tt.args...); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+	if got := ts.run("GET", "hll"); !strings.HasPrefix(got, "$12304\r\nHYLL") {
+		t.Errorf("expected the dense representation with the HYLL header, got %q", got[:min(len(got), 16)])
+	}
+}
+
+func TestHyperLogLogAccuracy(t *testing.T) {
+	ts := newTestServer(t)
+	const n = 10000
+	for i := range n {
+		ts.run("PFADD", "hll", "element:"+strconv.Itoa(i))
+	}
+	got, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(ts.run("PFCOUNT", "hll"), ":"), "\r\n"))
+	if err != nil {
+		t.Fatalf("expected an integer reply: %s", err)
+	}
+	if diff := got - n; diff < -n/50 || diff > n/50 {
+		t.Errorf("expected the estimate within 2%% of %d, got %d", n, got)
+	}
+}
+
+func TestDebugSetActiveExpire(t *testing.T) {
+	ts := newTestServer(t)
+	if got := ts.run("DEBUG", "SET-ACTIVE-EXPIRE", "0"); got != "+OK\r\n" {
+		t.Fatalf("expected %q, got %q", "+OK\r\n", got)
+	}
+	ts.run("SET", "key", "value")
+	ts.ttl.SetTTL("key", time.Now().Add(50*time.Millisecond))
+
+	time.Sleep(200 * time.Millisecond)
+	if _, ok := ts.store.Get("key"); !ok {
+		t.Fatalf("expected the expired key to stay in the store until accessed")
+	}
+	if got := ts.run("GET", "key"); got != "$-1\r\n" {
+		t.Errorf("expected the expired key to be missing on access, got %q", got)
+	}
+	if _, ok := ts.store.Get("key"); ok {
+		t.Errorf("expected the expired key to be removed on access")
+	}
+
+	ts.run("DEBUG", "SET-ACTIVE-EXPIRE", "1")
+	ts.run("SET", "other", "value")
+	ts.ttl.SetTTL("other", time.Now().Add(50*time.Millisecond))
+	if !waitFor(t, time.Second, func() bool { _, ok := ts.store.Get("other"); return !ok }) {
+		t.Errorf("expected the key to be expired in the background")
+	}
+}
+
+func TestExpireOnExpiredKey(t *testing.T) {
+	ts := newTestServer(t)
+	// Keep the key in the store past its TTL, as if the background worker hadn't caught up yet
+	ts.run("DEBUG", "SET-ACTIVE-EXPIRE", "0")
+	ts.run("SET", "key", "value")
+	ts.ttl.SetTTL("key", time.Now().Add(-time.Second))
+	ts.run("SET", "other", "value")
+	ts.ttl.SetTTL("other", time.Now().Add(-time.Second))
+
+	if got := ts.run("EXPIRE", "key", "100"); got != ":0\r\n" {
+		t.Errorf("expected an expired key not to be re-armed, got %q", got)
+	}
+	if got := ts.run("TTL", "key"); got != ":-2\r\n" {
+		t.Errorf("expected TTL of an expired key to be -2, got %q", got)
+	}
+	if got := ts.run("PTTL", "other"); got != ":-2\r\n" {
+		t.Errorf("expected PTTL of an expired key to be -2, got %q", got)
+	}
+}
+
+func TestSetEx(t *testing.T) {
+	ts := newTestServer(t)
+	if got := ts.run("SETEX", "key", "100", "v"); got != "+OK\r\n" {
+		t.Fatalf("expected OK, got %q", got)
+	}
+	ts.run("SETEX", "key", "5", "v2")
+
+	pttl, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(ts.run("PTTL", "key"), ":"), "\r\n"), 10, 64)
+	if err != nil || pttl <= 4000 || pttl > 5000 {
+		t.Errorf("expected PTTL to reflect the latest TTL of 5s, got %d (%v)", pttl, err)
+	}
+	if got := ts.run("GET", "key"); got != "$2\r\nv2\r\n" {
+		t.Errorf("expected the latest value, got %q", got)
+	}
+	if n := ts.ttl.Len(); n != 1 {
+		t.Errorf("expected a single TTL entry, got %d", n)
+	}
+
+	ts.run("PSETEX", "key", "1600", "v3")
+	if got := ts.run("TTL", "key"); got != ":2\r\n" {
+		t.Errorf("expected PSETEX to set a TTL in milliseconds, got %q", got)
+	}
+
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{name: "zero seconds", args: []string{"SETEX", "key", "0", "v"}, expected: "-ERR invalid expire time in 'setex' command\r\n"},
+		{name: "negative milliseconds", args: []string{"PSETEX", "key", "-1", "v"}, expected: "-ERR invalid expire time in 'psetex' command\r\n"},
+		{name: "overflowing seconds", args: []string{"SETEX", "key", "9223372036854775807", "v"}, expected: "-ERR invalid expire time in 'setex' command\r\n"},
+		{name: "not an integer", args: []string{"SETEX", "key", "soon", "v"}, expected: "-ERR value is not an integer or out of range\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ts.run(tt.args...); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+	if got := ts.run("GET", "key"); got != "$2\r\nv3\r\n" {
+		t.Errorf("expected rejected commands to keep the value, got %q", got)
+	}
+}
+
+func TestSetOptions(t *testing.T) {
+	ts := newTestServer(t)
+	ts.run("SET", "existing", "old")
+	ts.run("EXPIRE", "existing", "100")
+	pxat := strconv.FormatInt(time.Now().Add(100*time.Second).UnixMilli(), 10)
+
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+		value    string
+		ttl      string
+	}{
+		{name: "get on missing key", args: []string{"SET", "missing", "v", "GET"}, expected: "$-1\r\n", value: "$1\r\nv\r\n", ttl: ":-1\r\n"},
+		{name: "get on existing key", args: []string{"SET", "existing", "new", "GET"}, expected: "$3\r\nold\r\n", value: "$3\r\nnew\r\n", ttl: ":-1\r\n"},
+		{name: "nx get on existing key", args: []string{"SET", "existing", "other", "NX", "GET"}, expected: "$3\r\nnew\r\n", value: "$3\r\nnew\r\n", ttl: ":-1\r\n"},
+		{name: "nx on existing key", args: []string{"SET", "existing", "other", "NX"}, expected: "$-1\r\n", value: "$3\r\nnew\r\n", ttl: ":-1\r\n"},
+		{name: "nx on missing key", args: []string{"SET", "nx", "v", "nx"}, expected: "+OK\r\n", value: "$1\r\nv\r\n", ttl: ":-1\r\n"},
+		{name: "xx on missing key", args: []string{"SET", "xx", "v", "XX"}, expected: "$-1\r\n", value: "$-1\r\n", ttl: ":-2\r\n"},
+		{name: "xx get with ex", args: []string{"SET", "existing", "ex", "XX", "GET", "EX", "100"}, expected: "$3\r\nnew\r\n", value: "$2\r\nex\r\n", ttl: ":100\r\n"},
+		{name: "keepttl", args: []string{"SET", "existing", "kept", "KEEPTTL"}, expected: "+OK\r\n", value: "$4\r\nkept\r\n", ttl: ":100\r\n"},
+		{name: "px", args: []string{"SET", "px", "v", "PX", "1600"}, expected: "+OK\r\n", value: "$1\r\nv\r\n", ttl: ":2\r\n"},
+		{name: "pxat", args: []string{"SET", "pxat", "v", "PXAT", pxat}, expected: "+OK\r\n", value: "$1\r\nv\r\n", ttl: ":100\r\n"},
+		{name: "nx and xx", args: []string{"SET", "conflict", "v", "NX", "XX"}, expected: "-ERR syntax error\r\n", value: "$-1\r\n", ttl: ":-2\r\n"},
+		{name: "ex and keepttl", args: []string{"SET", "conflict", "v", "EX", "10", "KEEPTTL"}, expected: "-ERR syntax error\r\n", value: "$-1\r\n", ttl: ":-2\r\n"},
+		{name: "ex without value", args: []string{"SET", "conflict", "v", "EX"}, expected: "-ERR syntax error\r\n", value: "$-1\r\n", ttl: ":-2\r\n"},
+		{name: "invalid ex", args: []string{"SET", "conflict", "v", "EX", "0"}, expected: "-ERR invalid expire time in 'set' command\r\n", value: "$-1\r\n", ttl: ":-2\r\n"},
+		{name: "unknown option", args: []string{"SET", "conflict", "v", "NOPE"}, expected: "-ERR syntax error\r\n", value: "$-1\r\n", ttl: ":-2\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ts.run(tt.args...); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+			if got := ts.run("GET", tt.args[1]); got != tt.value {
+				t.Errorf("expected the value %q, got %q", tt.value, got)
+			}
+			if got := ts.run("TTL", tt.args[1]); got != tt.ttl {
+				t.Errorf("expected the TTL %q, got %q", tt.ttl, got)
+			}
+		})
+	}
+}
+
+func TestTTLRounding(t *testing.T) {
+	tests := []struct {
+		name      string
+		remaining time.Duration
+		ttl       string
+		minPTTL   int64
+	}{
+		{name: "rounds up", remaining: 1900 * time.Millisecond, ttl: ":2\r\n", minPTTL: 1800},
+		{name: "rounds down", remaining: 1400 * time.Millisecond, ttl: ":1\r\n", minPTTL: 1300},
+		{name: "less than half a second", remaining: 400 * time.Millisecond, ttl: ":0\r\n", minPTTL: 300},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			ts.run("SET", "key", "value")
+			ts.ttl.SetTTL("key", time.Now().Add(tt.remaining))
+
+			if got := ts.run("TTL", "key"); got != tt.ttl {
+				t.Errorf("expected TTL %q, got %q", tt.ttl, got)
+			}
+			got := ts.run("PTTL", "key")
+			pttl, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(got, ":"), "\r\n"), 10, 64)
+			if err != nil || pttl < tt.minPTTL || pttl > tt.remaining.Milliseconds() {
+				t.Errorf("expected PTTL in [%d, %d], got %q", tt.minPTTL, tt.remaining.Milliseconds(), got)
+			}
+		})
+	}
+
+	ts := newTestServer(t)
+	ts.run("SET", "persistent", "value")
+	if got := ts.run("PTTL", "persistent"); got != ":-1\r\n" {
+		t.Errorf("expected %q, got %q", ":-1\r\n", got)
+	}
+	if got := ts.run("PTTL", "missing"); got != ":-2\r\n" {
+		t.Errorf("expected %q, got %q", ":-2\r\n", got)
+	}
+}
+
+func TestLargeValueRoundTrip(t *testing.T) {
+	ts := newTestServer(t)
+	value := strings.Repeat("0123456789", 512*1024)
+	if got := ts.run("SET", "key", value); got != "+OK\r\n" {
+		t.Fatalf("expected %q, got %q", "+OK\r\n", got)
+	}
+	if got, expected := ts.run("GET", "key"), EncodeBulkString(&value); got != expected {
+		t.Errorf("expected a value of %d bytes, got a reply of %d bytes", len(value), len(got))
+	}
+}
+
+func TestProtoMaxBulkLen(t *testing.T) {
+	protoErr := "-ERR Protocol error: invalid bulk length\r\n"
+
+	t.Run("oversized length is rejected before allocation", func(t *testing.T) {
+		ts := newTestServer(t)
+		// The declared value is never sent: the request is rejected on the length alone
+		reader := bufio.NewReader(strings.NewReader("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$1099511627776\r\n"))
+		got, closeConn := ts.session.ParseCommand(context.Background(), reader)
+		if got != protoErr {
+			t.Errorf("expected %q, got %q", protoErr, got)
+		}
+		if !closeConn {
+			t.Errorf("expected the connection to be closed")
+		}
+	})
+
+	t.Run("negative length is rejected", func(t *testing.T) {
+		ts := newTestServer(t)
+		reader := bufio.NewReader(strings.NewReader("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$-5\r\n"))
+		got, closeConn := ts.session.ParseCommand(context.Background(), reader)
+		if got != protoErr {
+			t.Errorf("expected %q, got %q", protoErr, got)
+		}
+		if !closeConn {
+			t.Errorf("expected the connection to be closed")
+		}
+	})
+
+	t.Run("null bulk string is rejected", func(t *testing.T) {
+		ts := newTestServer(t)
+		reader := bufio.NewReader(strings.NewReader("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$-1\r\n"))
+		got, closeConn := ts.session.ParseCommand(context.Background(), reader)
+		if got != protoErr {
+			t.Errorf("expected %q, got %q", protoErr, got)
+		}
+		if !closeConn {
+			t.Errorf("expected the connection to be closed")
+		}
+		if _, ok := ts.store.Get("key"); ok {
+			t.Errorf("expected the key not to be set")
+		}
+	})
+
+	t.Run("configured limit", func(t *testing.T) {
+		SetProtoMaxBulkLen(8)
+		t.Cleanup(func() { SetProtoMaxBulkLen(DefaultProtoMaxBulkLen) })
+		ts := newTestServer(t)
+
+		parse := func(args ...string) (string, bool) {
+			return ts.session.ParseCommand(context.Background(), bufio.NewReader(strings.NewReader(encodeCommand(args...))))
+		}
+		got, closeConn := parse("SET", "key", "12345678")
+		if got != "+OK\r\n" {
+			t.Errorf("expected a value at the limit to be accepted, got %q", got)
+		}
+		if closeConn {
+			t.Fatalf("expected the connection to stay open")
+		}
+		got, closeConn = parse("SET", "key", "123456789")
+		if got != protoErr {
+			t.Errorf("expected %q, got %q", protoErr, got)
+		}
+		if !closeConn {
+			t.Errorf("expected the connection to be closed")
+		}
+	})
+
+	t.Run("connection is closed after the error reply", func(t *testing.T) {
+		SetProtoMaxBulkLen(8)
+		t.Cleanup(func() { SetProtoMaxBulkLen(DefaultProtoMaxBulkLen) })
+		ts := newTestServer(t)
+		conn, err := net.Dial("tcp", ts.serve(t))
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		defer func() { _ = conn.Close() }()
+
+		// Only the length is sent, so that the server has no unread input left when closing
+		if _, err := io.WriteString(conn, "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$9\r\n"); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		reply, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatalf("expected the server to close the connection, got %v", err)
+		}
+		if string(reply) != protoErr {
+			t.Errorf("expected %q, got %q", protoErr, reply)
+		}
+	})
+}
+
+func TestProtoMaxMultibulkLen(t *testing.T) {
+	protoErr := "-ERR Protocol error: invalid multibulk length\r\n"
+
+	t.Run("oversized count is rejected before allocation", func(t *testing.T) {
+		ts := newTestServer(t)
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		got, closeConn := ts.session.ParseCommand(context.Background(), bufio.NewReader(strings.NewReader("*1000000000\r\n")))
+		runtime.ReadMemStats(&after)
+		if got != protoErr {
+			t.Errorf("expected %q, got %q", protoErr, got)
+		}
+		if !closeConn {
+			t.Errorf("expected the connection to be closed")
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+			t.Errorf("expected no allocation for the elements, allocated %d bytes", allocated)
+		}
+	})
+
+	t.Run("configured limit", func(t *testing.T) {
+		SetProtoMaxMultibulkLen(3)
+		t.Cleanup(func() { SetProtoMaxMultibulkLen(DefaultProtoMaxMultibulkLen) })
+		ts := newTestServer(t)
+
+		if got := ts.run("SET", "key", "value"); got != "+OK\r\n" {
+			t.Errorf("expected a request at the limit to be accepted, got %q", got)
+		}
+		if got := ts.run("MSET", "a", "1", "b", "2"); got != protoErr {
+			t.Errorf("expected %q, got %q", protoErr, got)
+		}
+	})
+}
+
+func TestLolwut(t *testing.T) {
+	ts := newTestServer(t)
+	expected := "goradieschen ver. " + Version + "\n"
+
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{name: "no arguments", args: []string{"LOLWUT"}, expected: EncodeBulkString(&expected)},
+		{name: "version", args: []string{"LOLWUT", "VERSION", "5"}, expected: EncodeBulkString(&expected)},
+		{name: "invalid version", args: []string{"LOLWUT", "VERSION", "five"}, expected: "-ERR value is not an integer or out of range\r\n"},
+		{name: "unknown option", args: []string{"LOLWUT", "FOO"}, expected: "-ERR usage: LOLWUT [VERSION version]\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ts.run(tt.args...); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestMemoryUsage(t *testing.T) {
+	ts := newTestServer(t)
+	ts.run("MSET", "short", "v", "long", strings.Repeat("v", 100))
+
+	usage := func(args ...string) int64 {
+		t.Helper()
+		got := ts.run(append([]string{"MEMORY", "USAGE"}, args...)...)
+		n, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(got, ":"), "\r\n"), 10, 64)
+		if err != nil {
+			t.Fatalf("expected an integer reply, got %q", got)
+		}
+		return n
+	}
+
+	short, long := usage("short"), usage("long")
+	if short <= int64(len("short")+len("v")) {
+		t.Errorf("expected the estimate to include the entry overhead, got %d", short)
+	}
+	if long-short != 99-1 {
+		t.Errorf("expected a longer value to report more bytes, got %d and %d", short, long)
+	}
+	if got := usage("long", "SAMPLES", "5"); got != long {
+		t.Errorf("expected SAMPLES not to change the estimate of a string, got %d", got)
+	}
+	if got := ts.run("MEMORY", "USAGE", "missing"); got != "$-1\r\n" {
+		t.Errorf("expected %q, got %q", "$-1\r\n", got)
+	}
+	if got := ts.run("MEMORY", "USAGE", "short", "SAMPLES", "-1"); got != "-ERR value is not an integer or out of range\r\n" {
+		t.Errorf("expected an error for a negative count, got %q", got)
+	}
+}
+
+func TestMemoryStats(t *testing.T) {
+	ts := newTestServer(t)
+	ts.run("MSET", "a", "1", "b", "2", "c", "3")
+
+	got := ts.run("MEMORY", "STATS")
+	expected := "$10\r\nkeys.count\r\n" + EncodeInteger(int64(ts.store.Len()))
+	if !strings.Contains(got, expected) {
+		t.Errorf("expected the reply to contain %q, got %q", expected, got)
+	}
+	dataset := "$13\r\ndataset.bytes\r\n" + EncodeInteger(ts.store.UsedMemory())
+	if !strings.Contains(got, dataset) {
+		t.Errorf("expected the reply to contain %q, got %q", dataset, got)
+	}
+}
+
+func TestMemoryDoctor(t *testing.T) {
+	ts := newTestServer(t)
+	if got := ts.run("MEMORY", "DOCTOR"); !strings.Contains(got, "empty") {
+		t.Errorf("expected an empty instance to be reported, got %q", got)
+	}
+
+	ts.run("SET", "key", "value")
+	if got := ts.run("MEMORY", "DOCTOR"); !strings.Contains(got, "No memory issues found.") {
+		t.Errorf("expected no issues to be reported, got %q", got)
+	}
+
+	ts.evict.SetMaxMemory(ts.store.UsedMemory())
+	if got := ts.run("MEMORY", "DOCTOR"); !strings.Contains(got, "close to the maxmemory limit") {
+		t.Errorf("expected the maxmemory limit to be reported, got %q", got)
+	}
+}
+
+func TestInfoServerRunID(t *testing.T) {
+	ts := newTestServer(t)
+
+	runIDOf := func(reply string) string {
+		t.Helper()
+		for _, line := range strings.Split(reply, "\r\n") {
+			if id, ok := strings.CutPrefix(line, "run_id:"); ok {
+				return id
+			}
+		}
+		t.Fatalf("expected INFO server to contain run_id, got %q", reply)
+		return ""
+	}
+
+	first := runIDOf(ts.run("INFO", "server"))
+	if len(first) != 40 || strings.Trim(first, "0123456789abcdef") != "" {
+		t.Errorf("expected run_id of 40 hex characters, got %q", first)
+	}
+	if second := runIDOf(ts.run("INFO")); second != first {
+		t.Errorf("expected run_id to be stable, got %q and %q", first, second)
+	}
+}
+
+func TestInfoClients(t *testing.T) {
+	previous := metrics.Default()
+	t.Cleanup(func() { metrics.SetDefault(previous) })
+	stats := metrics.NewCollector()
+	metrics.SetDefault(stats)
+
+	ts := newTestServer(t)
+	stats.ClientConnected()
+	stats.ClientConnected()
+	expected := "# Clients\r\nconnected_clients:2\r\nmaxclients:0\r\nblocked_clients:0\r\n"
+	if got := ts.run("INFO", "clients"); got != EncodeBulkString(&expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+	stats.ClientDisconnected()
+	if got := ts.run("INFO"); !strings.Contains(got, "connected_clients:1\r\n") {
+		t.Errorf("expected the default sections to include the clients, got %q", got)
+	}
+}
+
+func TestInfoKeyspace(t *testing.T) {
+	ts := newTestServer(t)
+	if got := ts.run("INFO", "keyspace"); got != "$12\r\n# Keyspace\r\n\r\n" {
+		t.Errorf("expected an empty database not to be listed, got %q", got)
+	}
+
+	ts.run("MSET", "a", "1", "b", "2", "c", "3")
+	ts.run("EXPIRE", "a", "100")
+	ts.run("EXPIRE", "b", "100")
+	line := "db0:keys=3,expires=2,avg_ttl=0\r\n"
+	if got := ts.run("INFO", "keyspace"); !strings.Contains(got, line) {
+		t.Errorf("expected INFO keyspace to contain %q, got %q", line, got)
+	}
+	if got := ts.run("INFO"); !strings.Contains(got, line) {
+		t.Errorf("expected INFO to contain the keyspace section, got %q", got)
+	}
+	if got := ts.run("DBSIZE"); got != ":3\r\n" {
+		t.Errorf("expected DBSIZE to be 3, got %q", got)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	ts := newTestServer(t)
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{name: "abort with no failover in progress", args: []string{"FAILOVER", "abort"}, expected: "+OK\r\n"},
+		{name: "no replicas", args: []string{"FAILOVER"}, expected: "-ERR FAILOVER requires connected replicas.\r\n"},
+		{name: "no replicas with a target", args: []string{"FAILOVER", "TO", "127.0.0.1", "6380"}, expected: "-ERR FAILOVER requires connected replicas.\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ts.run(tt.args...); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestACL(t *testing.T) {
+	ts := newTestServer(t)
+	if got := ts.run("ACL", "SETUSER", "reader", "on", ">secret", "~*", "+get"); got != "+OK\r\n" {
+		t.Fatalf("expected OK, got %q", got)
+	}
+	ts.run("SET", "key", "value")
+
+	session := ts.newSession(io.Discard)
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{name: "wrong password", args: []string{"AUTH", "reader", "guess"}, expected: "-WRONGPASS invalid username-password pair or user is disabled.\r\n"},
+		{name: "auth", args: []string{"AUTH", "reader", "secret"}, expected: "+OK\r\n"},
+		{name: "allowed command", args: []string{"GET", "key"}, expected: "$5\r\nvalue\r\n"},
+		{name: "denied command", args: []string{"SET", "key", "other"}, expected: "-NOPERM User reader has no permissions to run the 'set' command\r\n"},
+		{name: "denied whoami", args: []string{"ACL", "WHOAMI"}, expected: "-NOPERM User reader has no permissions to run the 'acl' command\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := runIn(session, tt.args...); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+	if got := ts.run("GET", "key"); got != "$5\r\nvalue\r\n" {
+		t.Errorf("expected the denied SET not to run, got %q", got)
+	}
+	if got := ts.run("ACL", "WHOAMI"); got != "$7\r\ndefault\r\n" {
+		t.Errorf("expected the default user, got %q", got)
+	}
+	expected := EncodeArray([]string{"user default on nopass ~* +@all", "user reader on #2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b ~* -@all +get"})
+	if got := ts.run("ACL", "LIST"); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestACLKeyPatterns(t *testing.T) {
+	ts := newTestServer(t)
+	ts.run("ACL", "SETUSER", "app", "on", "nopass", "~app:*", "+@all")
+	session := ts.newSession(io.Discard)
+	runIn(session, "AUTH", "app", "")
+
+	if got := runIn(session, "SET", "app:1", "v"); got != "+OK\r\n" {
+		t.Errorf("expected a matching key to be accessible, got %q", got)
+	}
+	if got := runIn(session, "MSET", "app:2", "v", "other", "v"); got != "-NOPERM No permissions to access a key\r\n" {
+		t.Errorf("expected a key outside the patterns to be denied, got %q", got)
+	}
+	if got := ts.run("GET", "app:2"); got != "$-1\r\n" {
+		t.Errorf("expected the denied MSET not to run, got %q", got)
+	}
+	// The KEYS pattern isn't a key, so it isn't checked against the key patterns
+	for _, pattern := range []string{"app:*", "*"} {
+		if got := runIn(session, "KEYS", pattern); got != EncodeArray([]string{"app:1"}) {
+			t.Errorf("expected KEYS %s to run, got %q", pattern, got)
+		}
+	}
+}
+
+func TestNoAuth(t *testing.T) {
+	ts := newTestServer(t)
+	ts.run("ACL", "SETUSER", "default", ">secret")
+	session := ts.newSession(io.Discard)
+
+	if got := runIn(session, "GET", "key"); got != "-NOAUTH Authentication required.\r\n" {
+		t.Errorf("expected authentication to be required, got %q", got)
+	}
+	if got := runIn(session, "AUTH", "secret"); got != "+OK\r\n" {
+		t.Errorf("expected the default user to authenticate, got %q", got)
+	}
+	if got := runIn(session, "GET", "key"); got != "$-1\r\n" {
+		t.Errorf("expected commands to run once authenticated, got %q", got)
+	}
+}
+
+func TestHello(t *testing.T) {
+	ts := newTestServer(t)
+	ts.run("ACL", "SETUSER", "default", ">pass")
+	session := ts.newSession(io.Discard)
+
+	if got := runIn(session, "HELLO", "2", "AUTH", "default", "wrong"); got != "-WRONGPASS invalid username-password pair or user is disabled.\r\n" {
+		t.Errorf("expected a wrong password error, got %q", got)
+	}
+	got := runIn(session, "HELLO", "2", "AUTH", "default", "pass", "SETNAME", "app")
+	if !strings.HasPrefix(got, "*14\r\n") {
+		t.Errorf("expected a flat RESP2 array of 7 fields, got %q", got)
+	}
+	for _, field := range []string{"server", "version", "proto", "id", "mode", "role", "modules"} {
+		if !strings.Contains(got, "$"+strconv.Itoa(len(field))+"\r\n"+field+"\r\n") {
+			t.Errorf("expected the %s field, got %q", field, got)
+		}
+	}
+	if !strings.Contains(got, "$5\r\nproto\r\n:2\r\n") || !strings.Contains(got, "$4\r\nrole\r\n$6\r\nmaster\r\n") {
+		t.Errorf("expected proto 2 and the master role, got %q", got)
+	}
+	if !session.Authenticated || session.User != "default" || session.Protocol != 2 || session.Name != "app" {
+		t.Errorf("expected an authenticated RESP2 session named app, got %+v", session)
+	}
+	if got := runIn(session, "GET", "key"); got != "$-1\r\n" {
+		t.Errorf("expected commands to run once authenticated, got %q", got)
+	}
+
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{name: "unsupported version", args: []string{"HELLO", "4"}, expected: "-NOPROTO unsupported protocol version\r\n"},
+		{name: "resp3 isn't spoken", args: []string{"HELLO", "3"}, expected: "-NOPROTO unsupported protocol version\r\n"},
+		{name: "not an integer", args: []string{"HELLO", "three"}, expected: "-ERR Protocol version is not an integer or out of range\r\n"},
+		{name: "incomplete auth", args: []string{"HELLO", "2", "AUTH", "default"}, expected: "-ERR Syntax error in HELLO option 'AUTH'\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := runIn(session, tt.args...); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+	if got := runIn(session, "HELLO"); !strings.HasPrefix(got, "*14\r\n") || session.Protocol != 2 {
+		t.Errorf("expected HELLO without arguments to keep RESP2, got %q and %d", got, session.Protocol)
+	}
+}
+
+func TestMultiExec(t *testing.T) {
+	ts := newTestServer(t)
+	ts.run("SET", "text", "abc")
+	session := ts.newSession(io.Discard)
+
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{name: "exec without multi", args: []string{"EXEC"}, expected: "-ERR EXEC without MULTI\r\n"},
+		{name: "multi", args: []string{"MULTI"}, expected: "+OK\r\n"},
+		{name: "nested multi", args: []string{"MULTI"}, expected: "-ERR MULTI calls can not be nested\r\n"},
+		{name: "queue set", args: []string{"SET", "a", "1"}, expected: "+QUEUED\r\n"},
+		{name: "queue failing incr", args: []string{"INCR", "text"}, expected: "+QUEUED\r\n"},
+		{name: "queue incr", args: []string{"INCR", "a"}, expected: "+QUEUED\r\n"},
+		{name: "queue get", args: []string{"GET", "a"}, expected: "+QUEUED\r\n"},
+		{name: "exec", args: []string{"EXEC"}, expected: "*4\r\n+OK\r\n-ERR value is not an integer or out of range\r\n:2\r\n$1\r\n2\r\n"},
+		{name: "exec once", args: []string{"EXEC"}, expected: "-ERR EXEC without MULTI\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := runIn(session, tt.args...); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+	if got := ts.run("GET", "a"); got != "$1\r\n2\r\n" {
+		t.Errorf("expected the commands after the failing one to commit, got %q", got)
+	}
+}
+
+func TestMultiExecAbort(t *testing.T) {
+	tests := []struct {
+		name  string
+		queue [][]string
+		reply string
+	}{
+		{name: "unknown command", queue: [][]string{{"NOPE"}}, reply: "-ERR unknown command: NOPE\r\n"},
+		{name: "wrong arity", queue: [][]string{{"GET"}}, reply: "-ERR wrong number of arguments for 'get' command\r\n"},
+		{name: "not allowed", queue: [][]string{{"SYNC"}}, reply: "-ERR Command not allowed inside a transaction\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			session := ts.newSession(io.Discard)
+			runIn(session, "MULTI")
+			runIn(session, "SET", "a", "1")
+			for _, args := range tt.queue {
+				if got := runIn(session, args...); got != tt.reply {
+					t.Errorf("expected %q, got %q", tt.reply, got)
+				}
+			}
+			if got := runIn(session, "EXEC"); got != "-EXECABORT Transaction discarded because of previous errors.\r\n" {
+				t.Errorf("expected the transaction to be aborted, got %q", got)
+			}
+			if got := ts.run("GET", "a"); got != "$-1\r\n" {
+				t.Errorf("expected no queued command to run, got %q", got)
+			}
+		})
+	}
+}
+
+func TestMultiDiscard(t *testing.T) {
+	ts := newTestServer(t)
+	session := ts.newSession(io.Discard)
+	if got := runIn(session, "DISCARD"); got != "-ERR DISCARD without MULTI\r\n" {
+		t.Errorf("expected an error, got %q", got)
+	}
+	runIn(session, "MULTI")
+	runIn(session, "SET", "a", "1")
+	if got := runIn(session, "DISCARD"); got != "+OK\r\n" {
+		t.Errorf("expected OK, got %q", got)
+	}
+	if got := runIn(session, "GET", "a"); got != "$-1\r\n" {
+		t.Errorf("expected the discarded SET not to run, got %q", got)
+	}
+	runIn(session, "MULTI")
+	runIn(session, "SET", "a", "1")
+	if got := runIn(session, "RESET"); got != "+RESET\r\n" {
+		t.Errorf("expected RESET, got %q", got)
+	}
+	if got := runIn(session, "EXEC"); got != "-ERR EXEC without MULTI\r\n" {
+		t.Errorf("expected RESET to discard the transaction, got %q", got)
+	}
+}
+
+func TestMultiExecPropagation(t *testing.T) {
+	ts := newTestServer(t)
+	session := ts.newSession(io.Discard)
+	runIn(session, "SET", "text", "abc")
+	runIn(session, "MULTI")
+	runIn(session, "SET", "a", "1")
+	runIn(session, "INCR", "text")
+	runIn(session, "INCR", "a")
+	runIn(session, "GET", "a")
+	runIn(session, "EXEC")
+	// A transaction without a successful write isn't propagated
+	runIn(session, "MULTI")
+	runIn(session, "GET", "a")
+	runIn(session, "EXEC")
+
+	// Reads and failed writes are left out of the transaction
+	expected := encodeCommand("SET", "text", "abc") +
+		encodeCommand("MULTI") + encodeCommand("SET", "a", "1") + encodeCommand("INCR", "a") + encodeCommand("EXEC")
+	backlog := string(ts.repl.BacklogBytes())
+	if backlog != expected {
+		t.Fatalf("expected backlog %q, got %q", expected, backlog)
+	}
+
+	// A replica applies the transaction as a unit and passes it on the same way
+	replica := newTestServer(t)
+	link := replica.newSession(io.Discard)
+	reader := bufio.NewReader(strings.NewReader(backlog))
+	for range 5 {
+		if err := link.applyCommand(context.Background(), reader); err != nil {
+			t.Fatalf("expected the stream to be applied, got %s", err)
+		}
+	}
+	if got, _ := replica.store.Get("a"); got != "2" {
+		t.Errorf("expected the replica to apply the transaction, got a=%q", got)
+	}
+	if got := string(replica.repl.BacklogBytes()); got != expected {
+		t.Errorf("expected the replica backlog %q, got %q", expected, got)
+	}
+}
+
+func TestMultiExecRechecksPermissions(t *testing.T) {
+	ts := newTestServer(t)
+	ts.run("ACL", "SETUSER", "app", "on", "nopass", "~*", "+@all")
+	session := ts.newSession(io.Discard)
+	runIn(session, "AUTH", "app", "")
+	runIn(session, "MULTI")
+	runIn(session, "SET", "a", "1")
+	runIn(session, "INCR", "a")
+
+	// The permission is revoked after the command has been queued
+	ts.run("ACL", "SETUSER", "app", "-incr")
+	expected := "*2\r\n+OK\r\n-NOPERM User app has no permissions to run the 'incr' command\r\n"
+	if got := runIn(session, "EXEC"); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+	if got := ts.run("GET", "a"); got != "$1\r\n1\r\n" {
+		t.Errorf("expected the denied INCR not to run, got %q", got)
+	}
+}
+
+func TestCluster(t *testing.T) {
+	ts := newTestServer(t)
+	if got := ts.run("CLUSTER", "INFO"); !strings.Contains(got, "cluster_enabled:0\r\n") {
+		t.Errorf("expected CLUSTER INFO to report cluster_enabled:0, got %q", got)
+	}
+	for _, sub := range []string{"SLOTS", "SHARDS"} {
+		if got := ts.run("CLUSTER", sub); got != "*0\r\n" {
+			t.Errorf("expected CLUSTER %s to be empty, got %q", sub, got)
+		}
+	}
+	id := ts.run("CLUSTER", "MYID")
+	if !strings.HasPrefix(id, "$40\r\n") {
+		t.Errorf("expected a 40 characters node id, got %q", id)
+	}
+	if got := ts.run("CLUSTER", "myid"); got != id {
+		t.Errorf("expected the node id to be stable, got %q and %q", id, got)
+	}
+	if got := ts.run("CLUSTER", "NOPE"); got != "-ERR unknown subcommand 'NOPE'\r\n" {
+		t.Errorf("expected an unknown subcommand error, got %q", got)
+	}
+}
+
+func TestQuit(t *testing.T) {
+	ts := newTestServer(t)
+	conn, err := net.Dial("tcp", ts.serve(t))
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	if _, err := io.WriteString(conn, encodeCommand("QUIT")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("expected the server to close the connection, got %v", err)
+	}
+	if string(reply) != "+OK\r\n" {
+		t.Errorf("expected %q, got %q", "+OK\r\n", reply)
+	}
+}
+
+func TestParseCommandClientGone(t *testing.T) {
+	ts := newTestServer(t)
+	for _, input := range []string{"", "*2\r\n$3\r\nGET\r\n"} {
+		reply, closeConn := ts.session.ParseCommand(context.Background(), bufio.NewReader(strings.NewReader(input)))
+		if reply != "" || !closeConn {
+			t.Errorf("expected the connection to be closed without a reply on %q, got %q (close: %v)", input, reply, closeConn)
+		}
+	}
+}
+
+func TestWriteWhileExpirationPending(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+		// check is run once the pending deletion has been processed, expecting after
+		check []string
+		after string
+	}{
+		{name: "get", args: []string{"GET", "key"}, expected: "$-1\r\n", check: []string{"GET", "key"}, after: "$-1\r\n"},
+		{name: "append", args: []string{"APPEND", "key", "new"}, expected: ":3\r\n", check: []string{"GET", "key"}, after: "$3\r\nnew\r\n"},
+		{name: "incr", args: []string{"INCR", "key"}, expected: ":1\r\n", check: []string{"GET", "key"}, after: "$1\r\n1\r\n"},
+		{name: "setrange", args: []string{"SETRANGE", "key", "0", "new"}, expected: ":3\r\n", check: []string{"GET", "key"}, after: "$3\r\nnew\r\n"},
+		{name: "set keepttl", args: []string{"SET", "key", "new", "KEEPTTL"}, expected: "+OK\r\n", check: []string{"GET", "key"}, after: "$3\r\nnew\r\n"},
+		{name: "pfadd", args: []string{"PFADD", "key", "a"}, expected: ":1\r\n", check: []string{"PFCOUNT", "key"}, after: ":1\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			ts.ttl.Stop()
+			// The deletion of the expired key is held back until the command has run
+			picked, release, deleted := make(chan struct{}), make(chan struct{}), make(chan struct{})
+			ctx, cancel := context.WithCancel(context.Background())
+			t.Cleanup(cancel)
+			ts.ttl = ttlstore.NewTTLStore(ctx, func(key string) {
+				close(picked)
+				<-release
+				ExpireKey(ts.store, ts.ttl, ts.repl, key)
+				close(deleted)
+			})
+			ts.session = ts.newSession(io.Discard)
+
+			ts.run("SET", "key", "10", "PX", "1")
+			<-picked
+			if got := ts.run(tt.args...); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+			close(release)
+			<-deleted
+			// The command has cancelled the pending deletion, so its result is kept
+			if got := ts.run(tt.check...); got != tt.after {
+				t.Errorf("expected %q after the pending deletion, got %q", tt.after, got)
+			}
+		})
+	}
+}
+
+func TestDeleteClearsTTL(t *testing.T) {
+	tests := []struct {
+		name   string
+		delete func(ts *testServer)
+	}{
+		{name: "DEL", delete: func(ts *testServer) { ts.run("DEL", "key") }},
+		{name: "SET overwrite", delete: func(ts *testServer) { ts.run("SET", "key", "new") }},
+		{name: "MSET overwrite", delete: func(ts *testServer) { ts.run("MSET", "key", "new", "other", "value") }},
+		{name: "FLUSHALL", delete: func(ts *testServer) { ts.run("FLUSHALL") }},
+		{name: "BITOP with empty result", delete: func(ts *testServer) { ts.run("BITOP", "OR", "key", "missing") }},
+		{name: "BITOP overwrite", delete: func(ts *testServer) { ts.run("BITOP", "NOT", "key", "key") }},
+		{
+			name: "eviction",
+			delete: func(ts *testServer) {
+				ts.evict.SetPolicy(eviction.VolatileTTL)
+				ts.evict.SetMaxMemory(1)
+				ts.run("SET", "other", "value")
+			},
+		},
+		{
+			name: "lazy expiration",
+			delete: func(ts *testServer) {
+				ts.ttl.SetActiveExpire(false)
+				ts.ttl.SetTTL("key", time.Now().Add(-time.Second))
+				ts.run("GET", "key")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			ts.run("SET", "key", "value")
+			ts.run("EXPIRE", "key", "100")
+
+			tt.delete(ts)
+			if _, ok := ts.ttl.GetTTL("key"); ok {
+				t.Errorf("expected the TTL to be removed")
+			}
+		})
+	}
+}
+
+func TestDebugSleep(t *testing.T) {
+	ts := newTestServer(t)
+	sleeper := ts.newSession(io.Discard)
+
+	done := make(chan string, 1)
+	start := time.Now()
+	go func() { done <- runIn(sleeper, "DEBUG", "SLEEP", "0.3") }()
+	time.Sleep(50 * time.Millisecond)
+
+	// Other connections are served while the first one sleeps
+	if got := ts.run("SET", "key", "value"); got != "+OK\r\n" {
+		t.Errorf("expected SET to succeed, got %q", got)
+	}
+	if got := ts.run("GET", "key"); got != "$5\r\nvalue\r\n" {
+		t.Errorf("expected GET to succeed, got %q", got)
+	}
+	if elapsed := time.Since(start); elapsed >= 300*time.Millisecond {
+		t.Errorf("expected the other commands not to wait for the sleep, took %s", elapsed)
+	}
+	if got := <-done; got != "+OK\r\n" {
+		t.Errorf("expected OK, got %q", got)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("expected DEBUG SLEEP to take 300ms, took %s", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if got := runInContext(ctx, sleeper, "DEBUG", "SLEEP", "10"); got != "-ERR DEBUG SLEEP aborted: context canceled\r\n" {
+		t.Errorf("expected the sleep to be aborted, got %q", got)
+	}
+	for _, arg := range []string{"abc", "-1", "NaN", "1e300"} {
+		if got := ts.run("DEBUG", "SLEEP", arg); got != "-ERR value is not a valid float\r\n" {
+			t.Errorf("expected %s to be rejected, got %q", arg, got)
+		}
+	}
+}
+
+func TestDebugObject(t *testing.T) {
+	ts := newTestServer(t)
+	ts.run("MSET", "int", "42", "small", "hello", "large", strings.Repeat("x", 100))
+
+	tests := []struct {
+		key      string
+		expected string
+	}{
+		{key: "int", expected: "+Value at:0x0 refcount:2147483647 encoding:int serializedlength:2 lru_seconds_idle:0\r\n"},
+		{key: "small", expected: "+Value at:0x0 refcount:1 encoding:embstr serializedlength:5 lru_seconds_idle:0\r\n"},
+		{key: "large", expected: "+Value at:0x0 refcount:1 encoding:raw serializedlength:100 lru_seconds_idle:0\r\n"},
+		{key: "missing", expected: "-ERR no such key\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := ts.run("DEBUG", "OBJECT", tt.key); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestDebugStringMatchLen(t *testing.T) {
+	ts := newTestServer(t)
+	tests := []struct {
+		pattern  string
+		s        string
+		expected string
+	}{
+		{pattern: "[^a]", s: "b", expected: ":1\r\n"},
+		{pattern: "[^a]", s: "a", expected: ":0\r\n"},
+		{pattern: `\*`, s: "*", expected: ":1\r\n"},
+		{pattern: `\*`, s: "x", expected: ":0\r\n"},
+		{pattern: "user:*", s: "user:1/2", expected: ":1\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.s, func(t *testing.T) {
+			if got := ts.run("DEBUG", "STRINGMATCH-LEN", tt.pattern, tt.s); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package protocol
+
+import (
+	"strings"
+)
+
+// getRange returns the substring of val between the start and end offsets, both included.
+// Negative offsets count from the end of the string, out of range offsets are clamped.
+func getRange(val string, start, end int64) string {
+	size := int64(len(val))
+	if start < 0 && end < 0 && start > end {
+		return ""
+	}
+	if start < 0 {
+		start += size
+	}
+	if end < 0 {
+		end += size
+	}
+	start = max(start, 0)
+	end = max(end, 0)
+	end = min(end, size-1)
+	if size == 0 || start > end {
+		return ""
+	}
+	return val[start : end+1]
+}
+
+// setRange overwrites val with value starting at offset,
+// padding val with zero bytes if it's shorter than offset
+func setRange(val string, offset int64, value string) string {
+	if pad := offset - int64(len(val)); pad > 0 {
+		val += strings.Repeat("\x00", int(pad))
+	}
+	end := offset + int64(len(value))
+	if end >= int64(len(val)) {
+		return val[:offset] + value
+	}
+	return val[:offset] + value + val[end:]
+}
@@ -0,0 +1,120 @@
+package protocol
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// HandlerFunc executes a command for a session. The args don't include the command name
+// and their number has already been checked against the command arity.
+type HandlerFunc func(s *Session, args []string) string
+
+// Command describes a command the way it is reported by COMMAND, along with its handler
+type Command struct {
+	// Name is the upper-cased command name
+	Name string
+	// Arity is the number of arguments including the command name,
+	// a negative arity -N means at least N arguments
+	Arity int64
+	// Flags are the command flags, e.g. write, readonly, admin, fast or denyoom.
+	// They are reported by COMMAND and drive the checks done before running the command.
+	Flags []string
+	// FirstKey, LastKey and Step give the positions of the key arguments,
+	// a negative LastKey counts from the end of the arguments
+	FirstKey int64
+	LastKey  int64
+	Step     int64
+	Handler  HandlerFunc
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]*Command)
+)
+
+// Register adds a command to the registry, replacing any command of the same name
+func Register(cmd Command) {
+	cmd.Name = strings.ToUpper(cmd.Name)
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[cmd.Name] = &cmd
+}
+
+// lookupCommand returns the registered command for an upper-cased command name
+func lookupCommand(name string) (*Command, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	cmd, ok := registry[name]
+	return cmd, ok
+}
+
+// commands returns all registered commands sorted by name
+func commands() []*Command {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	cmds := make([]*Command, 0, len(registry))
+	for _, cmd := range registry {
+		cmds = append(cmds, cmd)
+	}
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].Name < cmds[j].Name })
+	return cmds
+}
+
+// checkArity reports whether the number of arguments, command name included, fits the arity
+func (c *Command) checkArity(n int) bool {
+	if c.Arity > 0 {
+		return int64(n) == c.Arity
+	}
+	return int64(n) >= -c.Arity
+}
+
+// hasFlag reports whether the command is registered with the flag
+func hasFlag(name, flag string) bool {
+	cmd, ok := lookupCommand(name)
+	if !ok {
+		return false
+	}
+	for _, f := range cmd.Flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// IsWrite reports whether the command, given by its name in any case, is registered as a write.
+// The read-only replica check and the propagation to replicas both rely on it.
+func IsWrite(cmd string) bool {
+	return hasFlag(strings.ToUpper(cmd), "write")
+}
+
+// IsReadOnly reports whether the command, given by its name in any case, is registered as read-only
+func IsReadOnly(cmd string) bool {
+	return hasFlag(strings.ToUpper(cmd), "readonly")
+}
+
+// getKeys extracts the key arguments from a full command line
+// (command name included) using the key positions of the registered command
+func getKeys(args []string) ([]string, error) {
+	cmd, ok := lookupCommand(strings.ToUpper(args[0]))
+	if !ok {
+		return nil, errors.New("Invalid command specified")
+	}
+	if !cmd.checkArity(len(args)) {
+		return nil, errors.New("Invalid number of arguments specified for command")
+	}
+	if cmd.FirstKey == 0 {
+		return nil, errors.New("The command has no key arguments")
+	}
+	last := cmd.LastKey
+	if last < 0 {
+		last += int64(len(args))
+	}
+	keys := []string{}
+	for i := cmd.FirstKey; i <= last && i < int64(len(args)); i += cmd.Step {
+		keys = append(keys, args[i])
+	}
+	return keys, nil
+}
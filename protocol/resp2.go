@@ -2,13 +2,61 @@ package protocol
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
+// DefaultProtoMaxBulkLen is the default size limit of a single bulk string in a request, 512MB like in Redis
+const DefaultProtoMaxBulkLen = 512 * 1024 * 1024
+
+// DefaultProtoMaxMultibulkLen is the default limit of the number of elements in a request, like in Redis
+const DefaultProtoMaxMultibulkLen = 1024 * 1024
+
+var protoMaxBulkLen atomic.Int64
+
+var protoMaxMultibulkLen atomic.Int64
+
+func init() {
+	protoMaxBulkLen.Store(DefaultProtoMaxBulkLen)
+	protoMaxMultibulkLen.Store(DefaultProtoMaxMultibulkLen)
+}
+
+// SetProtoMaxBulkLen sets the size limit of a single bulk string in a request
+func SetProtoMaxBulkLen(n int64) {
+	protoMaxBulkLen.Store(n)
+}
+
+// ProtoMaxBulkLen returns the size limit of a single bulk string in a request
+func ProtoMaxBulkLen() int64 {
+	return protoMaxBulkLen.Load()
+}
+
+// SetProtoMaxMultibulkLen sets the limit of the number of elements in a request
+func SetProtoMaxMultibulkLen(n int64) {
+	protoMaxMultibulkLen.Store(n)
+}
+
+// ProtoMaxMultibulkLen returns the limit of the number of elements in a request
+func ProtoMaxMultibulkLen() int64 {
+	return protoMaxMultibulkLen.Load()
+}
+
+// ProtocolError is returned for a malformed request the rest of the stream
+// can't be reliably read after, so the connection has to be closed
+type ProtocolError struct {
+	msg string
+}
+
+func (e *ProtocolError) Error() string {
+	return "Protocol error: " + e.msg
+}
+
 // DecodeCommand decodes a RESP2 command from a bufio.Reader into the command name and its arguments.
 func DecodeCommand(r *bufio.Reader) (string, []string, error) {
 
@@ -31,6 +79,11 @@ func DecodeCommand(r *bufio.Reader) (string, []string, error) {
 		return "", nil, errors.New("command must contain at least one element")
 	}
 
+	// Reject oversized requests before allocating the elements
+	if int64(count) > ProtoMaxMultibulkLen() {
+		return "", nil, &ProtocolError{msg: "invalid multibulk length"}
+	}
+
 	parts := make([]string, count)
 	for i := 0; i < count; i++ {
 		// Expect $<length>
@@ -45,6 +98,18 @@ func DecodeCommand(r *bufio.Reader) (string, []string, error) {
 		if err != nil {
 			return "", nil, fmt.Errorf("invalid bulk string length: %w", err)
 		}
+		// A null bulk string, or any other negative length, is not a valid request element
+		if length < 0 {
+			return "", nil, &ProtocolError{msg: "invalid bulk length"}
+		}
+		// Leave room for the trailing \r\n without overflowing the buffer size
+		if length > math.MaxInt-2 {
+			return "", nil, fmt.Errorf("invalid bulk string length: %d", length)
+		}
+		// Reject oversized values before allocating a buffer for them
+		if int64(length) > ProtoMaxBulkLen() {
+			return "", nil, &ProtocolError{msg: "invalid bulk length"}
+		}
 		buf := make([]byte, length+2) // +2 for \r\n
 		if _, err := io.ReadFull(r, buf); err != nil {
 			return "", nil, err
@@ -56,6 +121,16 @@ func DecodeCommand(r *bufio.Reader) (string, []string, error) {
 	return cmd, args, nil
 }
 
+// DecodeCommandBytes decodes a single RESP2 command from b, returning the command name
+// followed by its arguments. It lets the decoder be exercised without a connection, e.g. by fuzzing.
+func DecodeCommandBytes(b []byte) ([]string, error) {
+	cmd, args, err := DecodeCommand(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{cmd}, args...), nil
+}
+
 func readLine(r *bufio.Reader) (string, error) {
 	line, err := r.ReadString('\n')
 	if err != nil {
@@ -2,6 +2,8 @@ package protocol
 
 import (
 	"bufio"
+	"slices"
+	"strconv"
 	"strings"
 	"testing"
 )
@@ -99,6 +101,21 @@ func TestDecodeCommand(t *testing.T) {
 			input:         "*2\r\n$abc\r\nSET\r\n$3\r\nkey\r\n",
 			expectedError: "invalid bulk string length:",
 		},
+		{
+			name:          "Null bulk string",
+			input:         "*3\r\n$3\r\nSET\r\n$-1\r\n$5\r\nvalue\r\n",
+			expectedError: "Protocol error: invalid bulk length",
+		},
+		{
+			name:          "Invalid bulk string length - negative",
+			input:         "*2\r\n$-5\r\nSET\r\n$3\r\nkey\r\n",
+			expectedError: "Protocol error: invalid bulk length",
+		},
+		{
+			name:          "Invalid bulk string length - overflowing",
+			input:         "*2\r\n$9223372036854775807\r\nSET\r\n$3\r\nkey\r\n",
+			expectedError: "invalid bulk string length: 9223372036854775807",
+		},
 		{
 			name:          "Incomplete command - missing data",
 			input:         "*2\r\n$3\r\nSET\r\n$3\r\n",
@@ -185,6 +202,22 @@ func TestDecodeCommandEdgeCases(t *testing.T) {
 		}
 	})
 
+	t.Run("Value larger than the read buffer", func(t *testing.T) {
+		value := strings.Repeat("v", 5*1024*1024)
+		input := "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+		reader := bufio.NewReaderSize(strings.NewReader(input), 16)
+		cmd, args, err := DecodeCommand(reader)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if cmd != "SET" || len(args) != 2 || args[0] != "key" {
+			t.Fatalf("unexpected command %q with arguments %d", cmd, len(args))
+		}
+		if args[1] != value {
+			t.Errorf("expected a value of %d bytes to round-trip, got %d bytes", len(value), len(args[1]))
+		}
+	})
+
 	t.Run("Large number of arguments", func(t *testing.T) {
 		// MSET key1 val1 key2 val2 key3 val3
 		input := "*7\r\n$4\r\nMSET\r\n$4\r\nkey1\r\n$4\r\nval1\r\n$4\r\nkey2\r\n$4\r\nval2\r\n$4\r\nkey3\r\n$4\r\nval3\r\n"
@@ -602,3 +635,44 @@ func TestEncodeElementTypes(t *testing.T) {
 		}
 	})
 }
+
+func FuzzDecodeCommand(f *testing.F) {
+	for _, seed := range []string{
+		"*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n",
+		"*1\r\n$4\r\nPING\r\n",
+		"*1\r\n$0\r\n\r\n",
+		"*-1\r\n",
+		"*1\r\n$-1\r\n",
+		"*1\r\n$-5\r\n",
+		"*2\r\n$3\r\nGET\r\n",
+		"*99999999999999999999\r\n",
+		"*1\r\n$99999999999999999999\r\n",
+		"PING\r\n",
+		"",
+	} {
+		f.Add([]byte(seed))
+	}
+	// Keep the allocations the decoder may make for a single input small
+	defer SetProtoMaxBulkLen(ProtoMaxBulkLen())
+	defer SetProtoMaxMultibulkLen(ProtoMaxMultibulkLen())
+	SetProtoMaxBulkLen(1024)
+	SetProtoMaxMultibulkLen(1024)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		parts, err := DecodeCommandBytes(data)
+		if err != nil {
+			return
+		}
+		if len(parts) == 0 {
+			t.Fatalf("expected at least the command name for %q", data)
+		}
+		// A decoded command encodes back to a request decoding to the same parts
+		again, err := DecodeCommandBytes([]byte(EncodeArray(parts)))
+		if err != nil {
+			t.Fatalf("re-decoding %q: %s", parts, err)
+		}
+		if !slices.Equal(again, parts) {
+			t.Errorf("expected %q, got %q", parts, again)
+		}
+	})
+}
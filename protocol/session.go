@@ -0,0 +1,91 @@
+package protocol
+
+import (
+	"bufio"
+	"context"
+	"github.com/pilosus/goradieschen/acl"
+	"github.com/pilosus/goradieschen/eviction"
+	"github.com/pilosus/goradieschen/replication"
+	"github.com/pilosus/goradieschen/ttlstore"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// lastClientID is the id given to the most recently created session
+var lastClientID atomic.Int64
+
+// Session holds the state of a single client connection.
+// A session is used by one connection goroutine at a time and is not safe for concurrent use.
+type Session struct {
+	// DB is the index of the selected database
+	DB int
+	// Authenticated reports whether the client is allowed to run commands
+	Authenticated bool
+	// User is the name of the ACL user the client is authenticated as
+	User string
+	// Name is the name the client has given to the connection
+	Name string
+	// Queue holds the commands queued inside a transaction
+	Queue [][]string
+	// Subscriptions holds the pub/sub channels the client is subscribed to
+	Subscriptions map[string]struct{}
+	// Protocol is the RESP protocol version spoken by the client
+	Protocol int
+	// NoEvict exempts the client from client eviction, see CLIENT NO-EVICT
+	NoEvict bool
+	// NoTouch keeps the commands of the client from updating the access time of keys, see CLIENT NO-TOUCH
+	NoTouch bool
+
+	conn  io.Writer
+	store Store
+	ttl   *ttlstore.TTLStore
+	repl  *replication.State
+	evict *eviction.Evictor
+	users *acl.ACL
+	// ctx and reader are set for the duration of a command, for the handlers
+	// that abort on cancellation or take over the connection
+	ctx    context.Context
+	reader *bufio.Reader
+	// closing is set once the connection has to be closed after the reply is written
+	closing bool
+	// propagate is set while the session holds the replication write lock,
+	// it propagates the writes done in the meantime, see Session.write
+	propagate func(payload string)
+	// multi is set inside a MULTI transaction, multiFailed once a command
+	// couldn't be queued, which makes EXEC discard the transaction
+	multi       bool
+	multiFailed bool
+
+	// id, createdAt, lastInteraction, lastCommand and commands describe
+	// the connection in CLIENT INFO
+	id              int64
+	createdAt       time.Time
+	lastInteraction time.Time
+	lastCommand     string
+	commands        int64
+}
+
+// NewSession creates a session for a client connection. The conn is only
+// written to directly when the client turns into a replica via SYNC, regular
+// replies are returned by ParseCommand.
+func NewSession(conn io.Writer, store Store, ttl *ttlstore.TTLStore, repl *replication.State, evict *eviction.Evictor, users *acl.ACL) *Session {
+	now := time.Now()
+	return &Session{
+		// Clients are authenticated as the default user unless it needs a password
+		Authenticated: users.NoPass(acl.DefaultUser),
+		User:          acl.DefaultUser,
+		Subscriptions: make(map[string]struct{}),
+		Protocol:      2,
+		conn:          conn,
+		store:         store,
+		ttl:           ttl,
+		repl:          repl,
+		evict:         evict,
+		users:         users,
+
+		id:              lastClientID.Add(1),
+		createdAt:       now,
+		lastInteraction: now,
+	}
+}
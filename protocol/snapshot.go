@@ -0,0 +1,27 @@
+package protocol
+
+import (
+	"github.com/pilosus/goradieschen/ttlstore"
+	"time"
+)
+
+// Snapshot is a point-in-time copy of the keyspace along with the TTLs of the keys,
+// which background saves serialize while the server keeps serving commands
+type Snapshot struct {
+	Data map[string]string
+	// Expires holds the expiration times of the keys in Data that have a TTL
+	Expires map[string]time.Time
+}
+
+// takeSnapshot copies the keyspace and its TTLs. The two are copied one after the other,
+// so the TTLs of the keys missing from the copied keyspace are left out.
+func takeSnapshot(store Store, ttl *ttlstore.TTLStore) Snapshot {
+	data := store.Snapshot()
+	expires := ttl.Snapshot()
+	for key := range expires {
+		if _, ok := data[key]; !ok {
+			delete(expires, key)
+		}
+	}
+	return Snapshot{Data: data, Expires: expires}
+}
@@ -0,0 +1,38 @@
+package protocol
+
+import (
+	"context"
+	"github.com/pilosus/goradieschen/store"
+	"time"
+)
+
+// Store is the keyspace backend the commands operate on.
+// *store.Store is the in-memory implementation used by the server.
+type Store interface {
+	Get(key string) (string, bool)
+	// Peek returns the value like Get does, but without updating the access time of the key
+	Peek(key string) (string, bool)
+	Set(key, value string)
+	// SetRaw is like Set, but the value is reported with the raw encoding, see IsRaw
+	SetRaw(key, value string)
+	// IsRaw reports whether the value was stored with SetRaw since it was last set
+	IsRaw(key string) bool
+	// SetMany atomically sets multiple keys, pairs holds alternating keys and values
+	SetMany(pairs []string)
+	// SetManyNX is like SetMany, but only sets the keys if none of them exists
+	SetManyNX(pairs []string) bool
+	Delete(key string) bool
+	// DeleteMany deletes the keys at once, returning the number of keys that existed
+	DeleteMany(keys []string) int
+	Match(ctx context.Context, pattern string) ([]string, bool, error)
+	ForEach(fn func(key, value string) bool)
+	// Snapshot returns a copy of all keys and values, unaffected by later writes
+	Snapshot() map[string]string
+	FlushAll()
+	Len() int
+	AccessedAt(key string) (time.Time, bool)
+	MemoryUsage(key string) (int64, bool)
+	UsedMemory() int64
+}
+
+var _ Store = (*store.Store)(nil)
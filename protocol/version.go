@@ -0,0 +1,19 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// Version is the server version reported to clients
+const Version = "0.0.2"
+
+// runID randomly identifies the server process, so that clients can detect restarts
+var runID = newRunID()
+
+// newRunID generates a random identifier of 40 hex characters
+func newRunID() string {
+	b := make([]byte, 20)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,67 @@
+package replication
+
+// DefaultBacklogSize matches the default repl-backlog-size of Redis (1mb)
+const DefaultBacklogSize = 1024 * 1024
+
+// Backlog is a fixed-size ring buffer keeping the most recent bytes of the
+// replication stream, together with the replication offset: the total number
+// of bytes ever written to it. It is not safe for concurrent use.
+type Backlog struct {
+	buf     []byte
+	start   int // index of the oldest byte in buf
+	histLen int
+	offset  int64
+}
+
+func NewBacklog(size int) *Backlog {
+	return &Backlog{buf: make([]byte, size)}
+}
+
+// Write appends p to the backlog, overwriting the oldest bytes once the buffer is full
+func (b *Backlog) Write(p []byte) {
+	b.offset += int64(len(p))
+	size := len(b.buf)
+	if len(p) >= size {
+		// Only the tail of p fits into the buffer
+		copy(b.buf, p[len(p)-size:])
+		b.start = 0
+		b.histLen = size
+		return
+	}
+	end := (b.start + b.histLen) % size
+	n := copy(b.buf[end:], p)
+	copy(b.buf, p[n:])
+	b.histLen += len(p)
+	if b.histLen > size {
+		b.start = (b.start + b.histLen - size) % size
+		b.histLen = size
+	}
+}
+
+// Offset returns the replication offset
+func (b *Backlog) Offset() int64 {
+	return b.offset
+}
+
+// Size returns the capacity of the backlog in bytes
+func (b *Backlog) Size() int {
+	return len(b.buf)
+}
+
+// HistLen returns the number of bytes currently held by the backlog
+func (b *Backlog) HistLen() int {
+	return b.histLen
+}
+
+// FirstByteOffset returns the replication offset of the oldest byte held by the backlog
+func (b *Backlog) FirstByteOffset() int64 {
+	return b.offset - int64(b.histLen) + 1
+}
+
+// Bytes returns a copy of the backlog contents, oldest byte first
+func (b *Backlog) Bytes() []byte {
+	out := make([]byte, b.histLen)
+	n := copy(out, b.buf[b.start:min(b.start+b.histLen, len(b.buf))])
+	copy(out[n:], b.buf[:b.histLen-n])
+	return out
+}
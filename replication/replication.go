@@ -0,0 +1,332 @@
+package replication
+
+import (
+	"bufio"
+	"context"
+	"github.com/pilosus/goradieschen/logger"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SyncCommand is the RESP2-encoded command a replica sends to request a full sync
+const SyncCommand = "*1\r\n$4\r\nSYNC\r\n"
+
+// reconnectDelay is the pause between attempts to (re)connect to the primary
+const reconnectDelay = time.Second
+
+// replicaQueueSize is the number of writes buffered for a replica, a replica falling further behind is dropped
+const replicaQueueSize = 10000
+
+// replicaWriteTimeout is how long a write to a replica may take before the replica is dropped
+const replicaWriteTimeout = 60 * time.Second
+
+// State holds the replication settings of a server instance.
+type State struct {
+	readOnly atomic.Bool
+
+	// writeMu serializes write commands with their propagation and with replica
+	// registration, so every replica observes writes in execution order
+	writeMu sync.Mutex
+	// mu guards the replicas and the backlog. It's never held while writing to a replica,
+	// so a slow replica holds up neither the writes nor the replication info.
+	mu       sync.Mutex
+	replicas map[*replica]struct{}
+	backlog  *Backlog
+	// writeTimeout is the write deadline of the replicas, see replicaWriteTimeout
+	writeTimeout time.Duration
+
+	linkMu     sync.Mutex
+	stopLink   context.CancelFunc
+	masterAddr string
+}
+
+// replica is a connected replica, its writes are queued and written by its own goroutine
+type replica struct {
+	w     io.Writer
+	queue chan string
+}
+
+// deadlineWriter is implemented by replica connections that support write deadlines
+type deadlineWriter interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// Info is a point-in-time view of the replication state, as reported by INFO replication
+type Info struct {
+	Role                   string
+	MasterAddr             string
+	ConnectedReplicas      int
+	Offset                 int64
+	BacklogSize            int
+	BacklogFirstByteOffset int64
+	BacklogHistLen         int
+}
+
+func NewState() *State {
+	return &State{
+		replicas:     make(map[*replica]struct{}),
+		backlog:      NewBacklog(DefaultBacklogSize),
+		writeTimeout: replicaWriteTimeout,
+	}
+}
+
+// SetReadOnly toggles the replica read-only mode. When enabled, write commands
+// are rejected and only read commands are served.
+func (s *State) SetReadOnly(readOnly bool) {
+	s.readOnly.Store(readOnly)
+}
+
+// ReadOnly reports whether the replica read-only mode is enabled.
+func (s *State) ReadOnly() bool {
+	return s.readOnly.Load()
+}
+
+// Write runs a write command via exec while holding the replication write lock.
+// If exec reports success, payload (the RESP-encoded command) is appended to
+// the replication backlog and queued for all connected replicas before the
+// lock is released.
+func (s *State) Write(payload string, exec func() (string, bool)) string {
+	var reply string
+	s.WriteFunc(func(propagate func(payload string)) {
+		var ok bool
+		reply, ok = exec()
+		if ok {
+			propagate(payload)
+		}
+	})
+	return reply
+}
+
+// WriteFunc runs fn while holding the replication write lock, so that several writes
+// are executed and propagated as a unit. fn propagates a write by calling propagate with
+// its payload, which is appended to the backlog and queued for the replicas right away.
+func (s *State) WriteFunc(fn func(propagate func(payload string))) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	fn(s.feed)
+}
+
+// feed appends payload to the backlog and queues it for every replica,
+// dropping the ones whose queue is full. Must be called with s.writeMu held.
+func (s *State) feed(payload string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.backlog.Write([]byte(payload))
+	for r := range s.replicas {
+		select {
+		case r.queue <- payload:
+		default:
+			logger.Warnf("Dropping replica that fell %d writes behind", replicaQueueSize)
+			s.dropReplica(r)
+		}
+	}
+}
+
+// AddReplica registers w as a replica and streams the output of fullSync to it,
+// followed by every write propagated from then on. The snapshot is taken under
+// the replication write lock, so no write can slip in between the snapshot and
+// the command stream. The returned function deregisters the replica.
+func (s *State) AddReplica(w io.Writer, fullSync func() string) func() {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	r := &replica{w: w, queue: make(chan string, replicaQueueSize)}
+	r.queue <- fullSync()
+
+	s.mu.Lock()
+	s.replicas[r] = struct{}{}
+	s.mu.Unlock()
+	go s.writeReplica(r)
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.removeReplica(r)
+	}
+}
+
+// writeReplica writes the queued payloads to the replica until it's removed
+// or a write fails, or doesn't complete within the write timeout
+func (s *State) writeReplica(r *replica) {
+	for payload := range r.queue {
+		if d, ok := r.w.(deadlineWriter); ok {
+			_ = d.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+		}
+		if _, err := io.WriteString(r.w, payload); err != nil {
+			s.mu.Lock()
+			// The replica may have been dropped already, which is what made the write fail
+			if s.dropReplica(r) {
+				logger.Warnf("Dropping replica after write error: %s", err)
+			}
+			s.mu.Unlock()
+			return
+		}
+	}
+}
+
+// dropReplica removes the replica and closes its connection, reporting whether
+// the replica was registered. Must be called with s.mu held.
+func (s *State) dropReplica(r *replica) bool {
+	if !s.removeReplica(r) {
+		return false
+	}
+	r.close()
+	return true
+}
+
+// removeReplica deregisters the replica and stops its writer, reporting whether
+// the replica was registered. Must be called with s.mu held.
+func (s *State) removeReplica(r *replica) bool {
+	if _, ok := s.replicas[r]; !ok {
+		return false
+	}
+	delete(s.replicas, r)
+	close(r.queue)
+	return true
+}
+
+// close closes the connection of a dropped replica, so that it reconnects and resyncs
+func (r *replica) close() {
+	if c, ok := r.w.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			logger.Warnf("Error closing replica connection: %s", err)
+		}
+	}
+}
+
+// Replicas returns the number of connected replicas.
+func (s *State) Replicas() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.replicas)
+}
+
+// Offset returns the current replication offset
+func (s *State) Offset() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.backlog.Offset()
+}
+
+// BacklogBytes returns a copy of the replication backlog contents, oldest byte first
+func (s *State) BacklogBytes() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.backlog.Bytes()
+}
+
+// Info returns the current replication state
+func (s *State) Info() Info {
+	masterAddr := s.MasterAddr()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info := Info{
+		Role:                   "master",
+		MasterAddr:             masterAddr,
+		ConnectedReplicas:      len(s.replicas),
+		Offset:                 s.backlog.Offset(),
+		BacklogSize:            s.backlog.Size(),
+		BacklogFirstByteOffset: s.backlog.FirstByteOffset(),
+		BacklogHistLen:         s.backlog.HistLen(),
+	}
+	if masterAddr != "" {
+		info.Role = "slave"
+	}
+	return info
+}
+
+// ReplicaOf starts replicating from the primary at addr, replacing any
+// existing link. Once connected, the instance requests a full sync and then
+// calls apply for every command streamed by the primary until the link fails,
+// in which case it reconnects.
+func (s *State) ReplicaOf(addr string, apply func(context.Context, *bufio.Reader) error) {
+	s.linkMu.Lock()
+	defer s.linkMu.Unlock()
+
+	if s.stopLink != nil {
+		s.stopLink()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopLink = cancel
+	s.masterAddr = addr
+
+	go s.runLink(ctx, addr, apply)
+}
+
+// StopReplication drops the link to the primary, turning the instance back into a primary.
+func (s *State) StopReplication() {
+	s.linkMu.Lock()
+	defer s.linkMu.Unlock()
+
+	if s.stopLink != nil {
+		s.stopLink()
+		s.stopLink = nil
+	}
+	s.masterAddr = ""
+}
+
+// MasterAddr returns the address of the primary, or an empty string if the instance is a primary.
+func (s *State) MasterAddr() string {
+	s.linkMu.Lock()
+	defer s.linkMu.Unlock()
+	return s.masterAddr
+}
+
+// runLink keeps the connection to the primary alive until ctx is cancelled
+func (s *State) runLink(ctx context.Context, addr string, apply func(context.Context, *bufio.Reader) error) {
+	for {
+		err := s.syncFrom(ctx, addr, apply)
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		logger.Warnf("Replication link with %s lost: %s", addr, err)
+
+		select {
+		case <-time.After(reconnectDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *State) syncFrom(ctx context.Context, addr string, apply func(context.Context, *bufio.Reader) error) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	// Unblock the reader below as soon as replication is stopped
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		if err := conn.Close(); err != nil {
+			logger.Warnf("Error closing replication link: %s", err)
+		}
+	}()
+
+	if _, err := io.WriteString(conn, SyncCommand); err != nil {
+		return err
+	}
+	logger.Infof("Replicating from primary: %s", addr)
+
+	reader := bufio.NewReader(conn)
+	for {
+		if err := apply(ctx, reader); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package replication
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWriteAdvancesOffset(t *testing.T) {
+	s := NewState()
+	var expected bytes.Buffer
+
+	for i := 0; i < 10; i++ {
+		value := strconv.Itoa(i)
+		payload := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+		reply := s.Write(payload, func() (string, bool) { return "+OK\r\n", true })
+		if reply != "+OK\r\n" {
+			t.Fatalf("expected the exec reply to be returned, got %q", reply)
+		}
+		expected.WriteString(payload)
+	}
+	// Failed writes are neither recorded nor propagated
+	s.Write("*1\r\n$3\r\nBAD\r\n", func() (string, bool) { return "-ERR\r\n", false })
+
+	if got := s.Offset(); got != int64(expected.Len()) {
+		t.Errorf("expected offset %d, got %d", expected.Len(), got)
+	}
+	if got := s.BacklogBytes(); !bytes.Equal(got, expected.Bytes()) {
+		t.Errorf("expected backlog %q, got %q", expected.String(), got)
+	}
+}
+
+func TestBacklog(t *testing.T) {
+	tests := []struct {
+		name            string
+		size            int
+		writes          []string
+		expectedBytes   string
+		expectedOffset  int64
+		expectedFirst   int64
+		expectedHistLen int
+	}{
+		{
+			name:            "empty backlog",
+			size:            8,
+			expectedBytes:   "",
+			expectedOffset:  0,
+			expectedFirst:   1,
+			expectedHistLen: 0,
+		},
+		{
+			name:            "writes fitting into the buffer",
+			size:            8,
+			writes:          []string{"abc", "def"},
+			expectedBytes:   "abcdef",
+			expectedOffset:  6,
+			expectedFirst:   1,
+			expectedHistLen: 6,
+		},
+		{
+			name:            "write wrapping around the buffer",
+			size:            8,
+			writes:          []string{"abcdef", "ghij"},
+			expectedBytes:   "cdefghij",
+			expectedOffset:  10,
+			expectedFirst:   3,
+			expectedHistLen: 8,
+		},
+		{
+			name:            "several wraparounds",
+			size:            4,
+			writes:          []string{"abc", "def", "ghi"},
+			expectedBytes:   "fghi",
+			expectedOffset:  9,
+			expectedFirst:   6,
+			expectedHistLen: 4,
+		},
+		{
+			name:            "write larger than the buffer",
+			size:            4,
+			writes:          []string{"ab", "cdefghij"},
+			expectedBytes:   "ghij",
+			expectedOffset:  10,
+			expectedFirst:   7,
+			expectedHistLen: 4,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBacklog(tt.size)
+			for _, w := range tt.writes {
+				b.Write([]byte(w))
+			}
+			if got := string(b.Bytes()); got != tt.expectedBytes {
+				t.Errorf("expected bytes %q, got %q", tt.expectedBytes, got)
+			}
+			if got := b.Offset(); got != tt.expectedOffset {
+				t.Errorf("expected offset %d, got %d", tt.expectedOffset, got)
+			}
+			if got := b.FirstByteOffset(); got != tt.expectedFirst {
+				t.Errorf("expected first byte offset %d, got %d", tt.expectedFirst, got)
+			}
+			if got := b.HistLen(); got != tt.expectedHistLen {
+				t.Errorf("expected history length %d, got %d", tt.expectedHistLen, got)
+			}
+		})
+	}
+}
+
+// waitForReplicas waits until the number of connected replicas is n
+func waitForReplicas(t *testing.T, s *State, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for s.Replicas() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d replicas, got %d", n, s.Replicas())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReplicaStream(t *testing.T) {
+	s := NewState()
+	primary, replica := net.Pipe()
+	defer replica.Close()
+
+	remove := s.AddReplica(primary, func() string { return "FULLSYNC" })
+	expected := "FULLSYNC"
+	for i := 0; i < 3; i++ {
+		payload := "SET" + strconv.Itoa(i)
+		s.Write(payload, func() (string, bool) { return "+OK\r\n", true })
+		expected += payload
+	}
+	got := make([]byte, len(expected))
+	if _, err := io.ReadFull(replica, got); err != nil {
+		t.Fatalf("reading the replication stream: %s", err)
+	}
+	if string(got) != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	remove()
+	if n := s.Replicas(); n != 0 {
+		t.Errorf("expected the replica to be removed, got %d replicas", n)
+	}
+}
+
+func TestStalledReplicaDoesNotBlockWrites(t *testing.T) {
+	s := NewState()
+	// The replica never reads, so the full sync is never written in full
+	primary, replica := net.Pipe()
+	defer replica.Close()
+	defer s.AddReplica(primary, func() string { return "FULLSYNC" })()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2*replicaQueueSize; i++ {
+			s.Write("SET", func() (string, bool) { return "+OK\r\n", true })
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes blocked on the stalled replica")
+	}
+	if got := s.Offset(); got != 3*2*replicaQueueSize {
+		t.Errorf("expected offset %d, got %d", 3*2*replicaQueueSize, got)
+	}
+
+	// The replica fell too far behind, so it's dropped and disconnected
+	waitForReplicas(t, s, 0)
+	if _, err := io.ReadAll(replica); err != nil {
+		t.Errorf("expected the connection to be closed, got %s", err)
+	}
+}
+
+func TestReplicaWriteTimeout(t *testing.T) {
+	s := NewState()
+	s.writeTimeout = 20 * time.Millisecond
+	primary, replica := net.Pipe()
+	defer replica.Close()
+	defer s.AddReplica(primary, func() string { return "FULLSYNC" })()
+
+	waitForReplicas(t, s, 1)
+	waitForReplicas(t, s, 0)
+}
@@ -3,23 +3,75 @@ package server
 import (
 	"bufio"
 	"context"
-	"log"
+	"github.com/pilosus/goradieschen/logger"
+	"github.com/pilosus/goradieschen/metrics"
+	"io"
 	"net"
+	"runtime/debug"
+	"sync"
 )
 
-func Start(ctx context.Context, addr string, handler func(*bufio.Reader) string) error {
-	ln, err := net.Listen("tcp", addr)
-	if err != nil {
-		return err
+// Handler serves the commands of a single client connection
+type Handler interface {
+	// ParseCommand reads and executes a single command. It returns the reply to write,
+	// which may be empty, and whether the connection has to be closed afterwards.
+	ParseCommand(ctx context.Context, reader *bufio.Reader) (string, bool)
+}
+
+// internalErrorReply is written to a client whose command has panicked before the connection is closed
+const internalErrorReply = "-ERR internal error\r\n"
+
+// DefaultReadBufferSize is the default size of the per-connection read buffer in bytes
+const DefaultReadBufferSize = 4096
+
+// Start serves client connections on addr until ctx is cancelled.
+// A new handler is created with newHandler for every accepted connection.
+func Start(ctx context.Context, addr string, newHandler func(conn net.Conn) Handler) error {
+	return StartAll(ctx, []string{addr}, DefaultReadBufferSize, newHandler)
+}
+
+// StartAll serves client connections on all the addresses until ctx is cancelled,
+// reading from every connection through a buffer of readBufferSize bytes.
+// Every address is bound before any connection is accepted, so the server
+// either listens on all of them or fails to start.
+func StartAll(ctx context.Context, addrs []string, readBufferSize int, newHandler func(conn net.Conn) Handler) error {
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, ln := range listeners {
+				_ = ln.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, ln)
 	}
+	Serve(ctx, listeners, readBufferSize, newHandler)
+	return nil
+}
 
-	log.Printf("Server is listening on port: %s", addr)
+// Serve accepts client connections on all the listeners until ctx is cancelled,
+// then closes the listeners and returns.
+func Serve(ctx context.Context, listeners []net.Listener, readBufferSize int, newHandler func(conn net.Conn) Handler) {
+	var wg sync.WaitGroup
+	for _, ln := range listeners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(ctx, ln, readBufferSize, newHandler)
+		}()
+	}
+	wg.Wait()
+}
+
+func serve(ctx context.Context, ln net.Listener, readBufferSize int, newHandler func(conn net.Conn) Handler) {
+	logger.Infof("Server is listening on: %s", ln.Addr())
 
 	go func() {
 		<-ctx.Done()
-		log.Println("Server shutdown initiated")
+		logger.Infof("Server shutdown initiated")
 		if err := ln.Close(); err != nil {
-			log.Printf("Error closing listener: %s", err)
+			logger.Warnf("Error closing listener: %s", err)
 		}
 	}()
 
@@ -28,35 +80,68 @@ func Start(ctx context.Context, addr string, handler func(*bufio.Reader) string)
 		if err != nil {
 			select {
 			case <-ctx.Done():
-				return nil // graceful shutdown
+				return // graceful shutdown
 			default:
-				log.Println("Accept error:", err)
+				logger.Errorf("Accept error: %s", err)
 				continue
 			}
 		}
-		go handleConnection(conn, handler)
+		go handleConnection(ctx, conn, readBufferSize, newHandler)
 	}
 }
 
-func handleConnection(conn net.Conn, handler func(*bufio.Reader) string) {
+func handleConnection(ctx context.Context, conn net.Conn, readBufferSize int, newHandler func(conn net.Conn) Handler) {
 	defer func() {
 		if err := conn.Close(); err != nil {
-			log.Printf("Error closing connection: %s", err)
+			logger.Warnf("Error closing connection: %s", err)
 		}
 	}()
 
-	log.Printf("Client connected: %s", conn.RemoteAddr())
-	reader := bufio.NewReader(conn)
+	logger.Infof("Client connected: %s", conn.RemoteAddr())
+	metrics.Default().ClientConnected()
+	defer metrics.Default().ClientDisconnected()
+
+	// Replies and the messages the handler writes on its own share a single writer
+	w := newConnWriter(conn)
+	defer w.stop()
+
+	// A panicking command only takes down its own connection, not the whole server
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Errorf("Panic serving %s: %v\n%s", conn.RemoteAddr(), r, debug.Stack())
+			_, _ = w.Write([]byte(internalErrorReply))
+		}
+	}()
+
+	reader := bufio.NewReaderSize(conn, readBufferSize)
+	handler := newHandler(writerConn{Conn: conn, w: w})
 
 	for {
-		response := handler(reader)
-		if response == "" {
-			log.Printf("Connection closed by handler")
-			return
+		response, closeConn := handler.ParseCommand(ctx, reader)
+		if response != "" {
+			if _, err := w.Write([]byte(response)); err != nil {
+				logger.Warnf("Write error: %s", err)
+				return
+			}
 		}
-		if _, err := conn.Write([]byte(response)); err != nil {
-			log.Printf("Write error: %s", err)
+		if closeConn {
+			logger.Infof("Connection closed by handler: %s", conn.RemoteAddr())
 			return
 		}
 	}
 }
+
+// writeAll writes the whole buffer, retrying short writes that don't report an error
+func writeAll(w io.Writer, b []byte) error {
+	for len(b) > 0 {
+		n, err := w.Write(b)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		b = b[n:]
+	}
+	return nil
+}
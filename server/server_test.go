@@ -0,0 +1,272 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/pilosus/goradieschen/acl"
+	"github.com/pilosus/goradieschen/eviction"
+	"github.com/pilosus/goradieschen/protocol"
+	"github.com/pilosus/goradieschen/replication"
+	"github.com/pilosus/goradieschen/store"
+	"github.com/pilosus/goradieschen/ttlstore"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeMultipleListeners(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := store.NewStore()
+	ttl := ttlstore.NewTTLStore(ctx, func(key string) { s.Delete(key) })
+	evict := eviction.New(s, ttl)
+	repl := replication.NewState()
+
+	var listeners []net.Listener
+	for i := 0; i < 2; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		listeners = append(listeners, ln)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		Serve(ctx, listeners, DefaultReadBufferSize, func(conn net.Conn) Handler {
+			return protocol.NewSession(conn, s, ttl, repl, evict, acl.New())
+		})
+		close(done)
+	}()
+
+	// A key written through one listener is visible through the other
+	requests := []struct {
+		args     []string
+		expected string
+	}{
+		{args: []string{"SET", "key", "value"}, expected: "+OK\r\n"},
+		{args: []string{"GET", "key"}, expected: "$5\r\n"},
+	}
+	for i, ln := range listeners {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to connect to %s: %v", ln.Addr(), err)
+		}
+		defer func() { _ = conn.Close() }()
+
+		req := requests[i]
+		if _, err := conn.Write([]byte(protocol.EncodeArray(req.args))); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read from %s: %v", ln.Addr(), err)
+		}
+		if line != req.expected {
+			t.Errorf("expected %q from %s, got %q", req.expected, ln.Addr(), line)
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected Serve to return once the context is cancelled")
+	}
+	for _, ln := range listeners {
+		if conn, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+			_ = conn.Close()
+			t.Errorf("expected listener %s to be closed", ln.Addr())
+		}
+	}
+}
+
+// lineHandler replies to every line it reads, an "empty" line gets an empty reply
+// and a "panic" line panics
+type lineHandler struct{}
+
+func (lineHandler) ParseCommand(ctx context.Context, reader *bufio.Reader) (string, bool) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", true
+	}
+	switch line = strings.TrimSpace(line); line {
+	case "empty":
+		return "", false
+	case "quit":
+		return "+OK\r\n", true
+	case "panic":
+		panic("handler panicked")
+	default:
+		return "+" + line + "\r\n", false
+	}
+}
+
+func TestHandleConnectionEmptyReply(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go Serve(ctx, []net.Listener{ln}, DefaultReadBufferSize, func(conn net.Conn) Handler { return lineHandler{} })
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	// An empty reply writes nothing and keeps the connection open
+	if _, err := conn.Write([]byte("empty\nping\nquit\n")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(conn)
+	for _, expected := range []string{"+ping\r\n", "+OK\r\n"} {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		if line != expected {
+			t.Errorf("expected %q, got %q", expected, line)
+		}
+	}
+	if _, err := reader.ReadByte(); err == nil {
+		t.Errorf("expected the connection to be closed after the reply")
+	}
+}
+
+// shortWriteConn writes at most limit bytes per call without reporting an error
+type shortWriteConn struct {
+	net.Conn
+	limit int
+}
+
+func (c shortWriteConn) Write(b []byte) (int, error) {
+	return c.Conn.Write(b[:min(len(b), c.limit)])
+}
+
+func TestHandleConnectionShortWrites(t *testing.T) {
+	server, client := net.Pipe()
+	defer func() { _ = client.Close() }()
+	go handleConnection(context.Background(), shortWriteConn{Conn: server, limit: 3}, DefaultReadBufferSize,
+		func(conn net.Conn) Handler { return lineHandler{} })
+
+	go func() { _, _ = client.Write([]byte("hello world\nquit\n")) }()
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	got, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if expected := "+hello world\r\n+OK\r\n"; string(got) != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestHandleConnectionPanic(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go Serve(ctx, []net.Listener{ln}, DefaultReadBufferSize, func(conn net.Conn) Handler { return lineHandler{} })
+
+	// The panicking connection gets an error reply and is closed
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if _, err := conn.Write([]byte("panic\n")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if string(got) != internalErrorReply {
+		t.Errorf("expected %q, got %q", internalErrorReply, got)
+	}
+
+	// The server keeps serving other connections
+	other, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect after the panic: %v", err)
+	}
+	defer func() { _ = other.Close() }()
+	if _, err := other.Write([]byte("ping\n")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	_ = other.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(other).ReadString('\n')
+	if err != nil || line != "+ping\r\n" {
+		t.Errorf("expected the server to stay up, got %q, %v", line, err)
+	}
+}
+
+// pushHandler writes a push message to its connection from another goroutine
+// while it replies to a "push" line, much like pub/sub messages would be delivered
+type pushHandler struct {
+	conn   net.Conn
+	pushed chan error
+}
+
+func (h pushHandler) ParseCommand(ctx context.Context, reader *bufio.Reader) (string, bool) {
+	if _, err := reader.ReadString('\n'); err != nil {
+		return "", true
+	}
+	go func() {
+		_, err := h.conn.Write([]byte("+" + strings.Repeat("p", 64) + "\r\n"))
+		h.pushed <- err
+	}()
+	return "+" + strings.Repeat("r", 64) + "\r\n", false
+}
+
+func TestHandleConnectionAsyncWrites(t *testing.T) {
+	server, client := net.Pipe()
+	defer func() { _ = client.Close() }()
+	pushed := make(chan error, 1)
+	// Writing in small chunks gives concurrent writes plenty of chances to interleave
+	go handleConnection(context.Background(), shortWriteConn{Conn: server, limit: 3}, DefaultReadBufferSize,
+		func(conn net.Conn) Handler { return pushHandler{conn: conn, pushed: pushed} })
+
+	go func() { _, _ = client.Write([]byte("push\n")) }()
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(client)
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		got[line] = true
+	}
+	for _, expected := range []string{"+" + strings.Repeat("p", 64) + "\r\n", "+" + strings.Repeat("r", 64) + "\r\n"} {
+		if !got[expected] {
+			t.Errorf("expected %q to be written in one piece, got %v", expected, got)
+		}
+	}
+	if err := <-pushed; err != nil {
+		t.Errorf("expected the push to be written, got %v", err)
+	}
+}
+
+func TestConnWriterStopped(t *testing.T) {
+	server, client := net.Pipe()
+	defer func() { _ = client.Close() }()
+	w := newConnWriter(server)
+	w.stop()
+	if _, err := w.Write([]byte("+OK\r\n")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("expected writes to fail once stopped, got %v", err)
+	}
+}
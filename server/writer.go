@@ -0,0 +1,75 @@
+package server
+
+import (
+	"net"
+)
+
+// writeRequest is a single message queued for the connection writer
+type writeRequest struct {
+	b    []byte
+	done chan error
+}
+
+// connWriter owns the writes to a connection. Replies and messages written
+// asynchronously, like the replication stream, are funneled through a single
+// goroutine, so each of them is written in full before the next one starts.
+type connWriter struct {
+	conn     net.Conn
+	requests chan writeRequest
+	stopped  chan struct{}
+	// err is the first write error, after which nothing more is written
+	err error
+}
+
+func newConnWriter(conn net.Conn) *connWriter {
+	w := &connWriter{
+		conn:     conn,
+		requests: make(chan writeRequest),
+		stopped:  make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *connWriter) run() {
+	for {
+		select {
+		case req := <-w.requests:
+			if w.err == nil {
+				w.err = writeAll(w.conn, req.b)
+			}
+			req.done <- w.err
+		case <-w.stopped:
+			return
+		}
+	}
+}
+
+// Write queues the message and waits until it has been written in full
+func (w *connWriter) Write(b []byte) (int, error) {
+	done := make(chan error, 1)
+	select {
+	case w.requests <- writeRequest{b: b, done: done}:
+	case <-w.stopped:
+		return 0, net.ErrClosed
+	}
+	if err := <-done; err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// stop stops the writer, later writes fail with net.ErrClosed
+func (w *connWriter) stop() {
+	close(w.stopped)
+}
+
+// writerConn is the connection handed to handlers, its writes go through the connection writer
+type writerConn struct {
+	net.Conn
+	w *connWriter
+}
+
+func (c writerConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
@@ -0,0 +1,122 @@
+package store
+
+// maxMatchNesting caps the recursion of StringMatch on patterns with many stars
+const maxMatchNesting = 1000
+
+// StringMatch reports whether s matches the glob-style pattern, following the
+// rules of the Redis stringmatchlen: * matches any sequence of bytes, ? matches
+// a single byte, [abc], [^abc] and [a-z] match classes of bytes and \ escapes
+// the next byte. Unlike filepath.Match, there are no path separators and an
+// unterminated class is not an error. With nocase, ASCII letters match regardless of case.
+func StringMatch(pattern, s string, nocase bool) bool {
+	skipLongerMatches := false
+	return stringMatch(pattern, s, nocase, &skipLongerMatches, 0)
+}
+
+func stringMatch(pattern, s string, nocase bool, skipLongerMatches *bool, nesting int) bool {
+	// Protection against abusive patterns
+	if nesting > maxMatchNesting {
+		return false
+	}
+
+	for len(pattern) > 0 && len(s) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for len(s) > 0 {
+				if stringMatch(pattern[1:], s, nocase, skipLongerMatches, nesting+1) {
+					return true
+				}
+				if *skipLongerMatches {
+					return false
+				}
+				s = s[1:]
+			}
+			// The rest of the pattern matches nowhere in the rest of the string,
+			// so earlier stars can't match either by consuming more bytes
+			*skipLongerMatches = true
+			return false
+		case '?':
+			pattern = pattern[1:]
+		case '[':
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+			match := false
+			for len(pattern) > 0 {
+				if pattern[0] == '\\' && len(pattern) >= 2 {
+					pattern = pattern[1:]
+					if pattern[0] == s[0] {
+						match = true
+					}
+				} else if pattern[0] == ']' {
+					break
+				} else if len(pattern) >= 3 && pattern[1] == '-' {
+					start, end, c := pattern[0], pattern[2], s[0]
+					if start > end {
+						start, end = end, start
+					}
+					if nocase {
+						start, end, c = toLower(start), toLower(end), toLower(c)
+					}
+					pattern = pattern[2:]
+					if c >= start && c <= end {
+						match = true
+					}
+				} else if equalByte(pattern[0], s[0], nocase) {
+					match = true
+				}
+				pattern = pattern[1:]
+			}
+			// Skip the closing bracket, if the class is terminated
+			if len(pattern) > 0 {
+				pattern = pattern[1:]
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if !equalByte(pattern[0], s[0], nocase) {
+				return false
+			}
+			pattern = pattern[1:]
+		}
+		s = s[1:]
+	}
+	// Trailing stars match the empty rest of the string, the empty string itself included
+	if len(s) == 0 {
+		for len(pattern) > 0 && pattern[0] == '*' {
+			pattern = pattern[1:]
+		}
+	}
+	return len(pattern) == 0 && len(s) == 0
+}
+
+func equalByte(a, b byte, nocase bool) bool {
+	if nocase {
+		return toLower(a) == toLower(b)
+	}
+	return a == b
+}
+
+func toLower(b byte) byte {
+	if b >= 'A' && b <= 'Z' {
+		return b + 'a' - 'A'
+	}
+	return b
+}
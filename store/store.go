@@ -1,58 +1,246 @@
 package store
 
 import (
-	"path/filepath"
+	"context"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// matchCheckInterval is the number of keys scanned between context checks in Match
+const matchCheckInterval = 1024
+
 type Store struct {
 	mu   sync.RWMutex
-	data map[string]string
+	data map[string]*entry
+	// used is the estimated memory taken by keys and values, in bytes
+	used int64
+}
+
+type entry struct {
+	value string
+	// raw is set for values modified in place, which keep the raw encoding like in Redis
+	raw bool
+	// accessed is the time of the last access in Unix nanoseconds,
+	// it's atomic so that reads only need the read lock
+	accessed atomic.Int64
+}
+
+func newEntry(value string) *entry {
+	e := &entry{value: value}
+	e.accessed.Store(time.Now().UnixNano())
+	return e
+}
+
+// entryOverhead estimates the bytes taken by an entry apart from the key and value
+// contents: the string headers, the entry struct and its slot in the map
+const entryOverhead = 48
+
+// entrySize estimates the memory taken by a key and its value
+func entrySize(key, value string) int64 {
+	return int64(len(key)+len(value)) + entryOverhead
 }
 
 func NewStore() *Store {
-	return &Store{data: make(map[string]string)}
+	return &Store{data: make(map[string]*entry)}
 }
 
 func (s *Store) Set(key, value string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.data[key] = value
+	s.set(key, value)
+}
+
+// set stores the value and updates the memory estimate. Must be called with s.mu held.
+func (s *Store) set(key, value string) {
+	if old, ok := s.data[key]; ok {
+		s.used -= entrySize(key, old.value)
+	}
+	s.data[key] = newEntry(value)
+	s.used += entrySize(key, value)
+}
+
+// SetRaw stores the value like Set, marking it as modified in place so that
+// it's reported with the raw encoding whatever it looks like
+func (s *Store) SetRaw(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.set(key, value)
+	s.data[key].raw = true
+}
+
+// IsRaw reports whether the value of the key was last stored with SetRaw
+func (s *Store) IsRaw(key string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.data[key]
+	return ok && e.raw
+}
+
+// SetMany atomically sets multiple keys, pairs holds alternating keys and values
+func (s *Store) SetMany(pairs []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i+1 < len(pairs); i += 2 {
+		s.set(pairs[i], pairs[i+1])
+	}
+}
+
+// SetManyNX atomically sets multiple keys only if none of them exists, pairs holds
+// alternating keys and values. It reports whether the keys have been set.
+func (s *Store) SetManyNX(pairs []string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if _, ok := s.data[pairs[i]]; ok {
+			return false
+		}
+	}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		s.set(pairs[i], pairs[i+1])
+	}
+	return true
 }
 
 func (s *Store) Get(key string) (string, bool) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	value, ok := s.data[key]
-	return value, ok
+	e, ok := s.data[key]
+	if !ok {
+		return "", false
+	}
+	e.accessed.Store(time.Now().UnixNano())
+	return e.value, true
+}
+
+// Peek returns the value of the key without updating its access time
+func (s *Store) Peek(key string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.data[key]
+	if !ok {
+		return "", false
+	}
+	return e.value, true
+}
+
+// AccessedAt returns the time the key was last written or read
+func (s *Store) AccessedAt(key string) (time.Time, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.data[key]
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, e.accessed.Load()), true
+}
+
+// MemoryUsage returns the estimated memory taken by the key and its value, in bytes
+func (s *Store) MemoryUsage(key string) (int64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.data[key]
+	if !ok {
+		return 0, false
+	}
+	return entrySize(key, e.value), true
 }
 
-func (s *Store) Match(pattern string) ([]string, bool) {
+// Len returns the number of keys in the store
+func (s *Store) Len() int {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
+	return len(s.data)
+}
+
+// UsedMemory returns the estimated memory taken by the dataset, in bytes
+func (s *Store) UsedMemory() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.used
+}
+
+// Match returns the keys matching the pattern. The scan is aborted
+// with the context error as soon as ctx is cancelled.
+func (s *Store) Match(ctx context.Context, pattern string) ([]string, bool, error) {
 	var found []string
-	for key := range s.data {
-		matched, _ := filepath.Match(pattern, key)
-		if matched {
+	var err error
+	scanned := 0
+	s.ForEach(func(key, _ string) bool {
+		if scanned%matchCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				return false
+			}
+		}
+		scanned++
+		if StringMatch(pattern, key, false) {
 			found = append(found, key)
 		}
+		return true
+	})
+	if err != nil {
+		return nil, false, err
 	}
 	if len(found) == 0 {
-		return found, false
+		return found, false, nil
 	}
-	return found, true
+	return found, true, nil
+}
+
+// ForEach calls fn for every key and value in the store, in no particular order,
+// until fn returns false. The store is read-locked for the whole iteration,
+// so fn must not call back into the store, or it may deadlock.
+func (s *Store) ForEach(fn func(key, value string) bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for key, e := range s.data {
+		if !fn(key, e.value) {
+			return
+		}
+	}
+}
+
+// Snapshot returns a copy of all keys and values taken under the read lock,
+// so that it can be serialized while the store keeps serving writes
+func (s *Store) Snapshot() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data := make(map[string]string, len(s.data))
+	for key, e := range s.data {
+		data[key] = e.value
+	}
+	return data
 }
 
 func (s *Store) Delete(key string) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	_, existed := s.data[key]
-	delete(s.data, key)
+	e, existed := s.data[key]
+	if existed {
+		s.used -= entrySize(key, e.value)
+		delete(s.data, key)
+	}
 	return existed
 }
 
+// DeleteMany deletes the keys under a single lock, returning the number of keys that existed
+func (s *Store) DeleteMany(keys []string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deleted := 0
+	for _, key := range keys {
+		if e, ok := s.data[key]; ok {
+			s.used -= entrySize(key, e.value)
+			delete(s.data, key)
+			deleted++
+		}
+	}
+	return deleted
+}
+
 func (s *Store) FlushAll() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.data = make(map[string]string)
+	s.data = make(map[string]*entry)
+	s.used = 0
 }
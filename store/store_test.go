@@ -0,0 +1,266 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cancelAfterContext reports cancellation once Err has been called more than limit times
+type cancelAfterContext struct {
+	context.Context
+	limit int
+	calls int
+}
+
+func (c *cancelAfterContext) Err() error {
+	c.calls++
+	if c.calls > c.limit {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestMatch(t *testing.T) {
+	s := NewStore()
+	s.SetMany([]string{"user:1", "a", "user:2", "b", "order:1", "c", "", "empty"})
+
+	tests := []struct {
+		name     string
+		pattern  string
+		expected int
+		ok       bool
+	}{
+		{name: "match all", pattern: "*", expected: 4, ok: true},
+		{name: "prefix", pattern: "user:*", expected: 2, ok: true},
+		{name: "single character", pattern: "order:?", expected: 1, ok: true},
+		{name: "no match", pattern: "missing*", expected: 0, ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, ok, err := s.Match(context.Background(), tt.pattern)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ok != tt.ok || len(keys) != tt.expected {
+				t.Errorf("expected %d keys (ok=%v), got %v (ok=%v)", tt.expected, tt.ok, keys, ok)
+			}
+		})
+	}
+}
+
+func TestMatchCancelledMidScan(t *testing.T) {
+	s := NewStore()
+	const total = 10 * matchCheckInterval
+	for i := 0; i < total; i++ {
+		s.Set("key:"+strconv.Itoa(i), "v")
+	}
+
+	// Cancel the context after the scan has checked it twice
+	ctx := &cancelAfterContext{Context: context.Background(), limit: 2}
+	keys, ok, err := s.Match(ctx, "*")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if ok || keys != nil {
+		t.Errorf("expected no keys for an aborted scan, got %d keys", len(keys))
+	}
+	// The scan stops at the first check after cancellation instead of visiting every key
+	if ctx.calls != 3 {
+		t.Errorf("expected the scan to stop after 3 context checks, got %d", ctx.calls)
+	}
+}
+
+func TestForEach(t *testing.T) {
+	s := NewStore()
+	for i := 0; i < 10; i++ {
+		s.Set("key:"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+
+	tests := []struct {
+		name     string
+		stopAt   int
+		expected int
+	}{
+		{name: "full iteration", stopAt: -1, expected: 10},
+		{name: "stop on the first key", stopAt: 1, expected: 1},
+		{name: "stop midway", stopAt: 5, expected: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			visited := 0
+			s.ForEach(func(key, value string) bool {
+				visited++
+				if v := s.data[key]; v.value != value {
+					t.Errorf("expected value %q for %s, got %q", v.value, key, value)
+				}
+				return visited != tt.stopAt
+			})
+			if visited != tt.expected {
+				t.Errorf("expected %d keys to be visited, got %d", tt.expected, visited)
+			}
+		})
+	}
+}
+
+func TestPeekKeepsAccessTime(t *testing.T) {
+	s := NewStore()
+	s.Set("key", "value")
+	before, _ := s.AccessedAt("key")
+	time.Sleep(time.Millisecond)
+
+	if val, ok := s.Peek("key"); !ok || val != "value" {
+		t.Fatalf("expected to peek value, got %q, %v", val, ok)
+	}
+	if after, _ := s.AccessedAt("key"); !after.Equal(before) {
+		t.Errorf("expected Peek to keep the access time %v, got %v", before, after)
+	}
+	s.Get("key")
+	if after, _ := s.AccessedAt("key"); !after.After(before) {
+		t.Errorf("expected Get to update the access time past %v, got %v", before, after)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	s := NewStore()
+	s.SetMany([]string{"a", "1", "b", "2"})
+	snapshot := s.Snapshot()
+
+	s.Set("a", "changed")
+	s.Delete("b")
+	s.Set("c", "3")
+	s.FlushAll()
+
+	expected := map[string]string{"a": "1", "b": "2"}
+	if !reflect.DeepEqual(snapshot, expected) {
+		t.Errorf("expected the snapshot to be unaffected by later writes, got %v", snapshot)
+	}
+}
+
+func TestSetRaw(t *testing.T) {
+	s := NewStore()
+	s.SetRaw("key", "1")
+	if val, ok := s.Get("key"); !ok || val != "1" || !s.IsRaw("key") {
+		t.Errorf("expected a raw value, got %q, %v, %v", val, ok, s.IsRaw("key"))
+	}
+	s.Set("key", "2")
+	if s.IsRaw("key") {
+		t.Errorf("expected Set to reset the raw encoding")
+	}
+	if s.IsRaw("missing") {
+		t.Errorf("expected a missing key not to be raw")
+	}
+}
+
+func TestDeleteMany(t *testing.T) {
+	s := NewStore()
+	s.SetMany([]string{"a", "1", "b", "2", "c", "3"})
+	if n := s.DeleteMany([]string{"a", "b", "a", "missing"}); n != 2 {
+		t.Errorf("expected 2 deleted keys, got %d", n)
+	}
+	if snapshot := s.Snapshot(); len(snapshot) != 1 || snapshot["c"] != "3" {
+		t.Errorf("expected only c to be left, got %v", snapshot)
+	}
+	if used := s.UsedMemory(); used != entrySize("c", "3") {
+		t.Errorf("expected the memory estimate of c only, got %d", used)
+	}
+}
+
+func benchmarkKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = "key:" + strconv.Itoa(i)
+	}
+	return keys
+}
+
+func fill(s *Store, keys []string) {
+	for _, key := range keys {
+		s.Set(key, "value")
+	}
+}
+
+func BenchmarkDelete1000(b *testing.B) {
+	keys := benchmarkKeys(1000)
+	s := NewStore()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		fill(s, keys)
+		b.StartTimer()
+		for _, key := range keys {
+			s.Delete(key)
+		}
+	}
+}
+
+func BenchmarkDeleteMany1000(b *testing.B) {
+	keys := benchmarkKeys(1000)
+	s := NewStore()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		fill(s, keys)
+		b.StartTimer()
+		s.DeleteMany(keys)
+	}
+}
+
+func TestStringMatch(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		s        string
+		nocase   bool
+		expected bool
+	}{
+		{pattern: "*", s: "anything", expected: true},
+		{pattern: "*", s: "a/b", expected: true},
+		{pattern: "*", s: "", expected: true},
+		{pattern: "**", s: "", expected: true},
+		{pattern: "a*", s: "a", expected: true},
+		{pattern: "?*", s: "", expected: false},
+		{pattern: "h?llo", s: "hello", expected: true},
+		{pattern: "h?llo", s: "hllo", expected: false},
+		{pattern: "h*llo", s: "heeeello", expected: true},
+		{pattern: "h[ae]llo", s: "hallo", expected: true},
+		{pattern: "h[ae]llo", s: "hillo", expected: false},
+		{pattern: "h[^e]llo", s: "hallo", expected: true},
+		{pattern: "h[^e]llo", s: "hello", expected: false},
+		{pattern: "[^a]", s: "a", expected: false},
+		{pattern: "[^a]", s: "b", expected: true},
+		{pattern: "h[a-b]llo", s: "hbllo", expected: true},
+		{pattern: "h[b-a]llo", s: "hbllo", expected: true},
+		{pattern: "h[a-b]llo", s: "hcllo", expected: false},
+		{pattern: `\*`, s: "*", expected: true},
+		{pattern: `\*`, s: "a", expected: false},
+		{pattern: `a\?c`, s: "a?c", expected: true},
+		{pattern: `a\?c`, s: "abc", expected: false},
+		{pattern: `[\]]`, s: "]", expected: true},
+		{pattern: "[abc", s: "a", expected: true},
+		{pattern: "key:*:suffix", s: "key:1:2:suffix", expected: true},
+		{pattern: "a*b*c", s: "aXbYc", expected: true},
+		{pattern: "a*b*c", s: "aXbYd", expected: false},
+		{pattern: "HELLO", s: "hello", expected: false},
+		{pattern: "HELLO", s: "hello", nocase: true, expected: true},
+		{pattern: "[A-Z]", s: "q", nocase: true, expected: true},
+		{pattern: "a*", s: "a", expected: true},
+		{pattern: "a**", s: "a", expected: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.s, func(t *testing.T) {
+			if got := StringMatch(tt.pattern, tt.s, tt.nocase); got != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestStringMatchAbusivePattern(t *testing.T) {
+	pattern := strings.Repeat("*a", 50) + "b"
+	s := strings.Repeat("a", 100)
+	if StringMatch(pattern, s, false) {
+		t.Errorf("expected no match")
+	}
+}
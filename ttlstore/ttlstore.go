@@ -3,7 +3,10 @@ package ttlstore
 import (
 	"container/heap"
 	"context"
+	"math/rand/v2"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -54,12 +57,27 @@ func (h TTLHeap) Peek() *TTLItem {
 }
 
 type TTLStore struct {
-	mu       sync.Mutex
-	heap     TTLHeap
-	entries  map[string]*TTLItem
-	wake     chan struct{}
-	stop     chan struct{}
+	mu      sync.Mutex
+	heap    TTLHeap
+	entries map[string]*TTLItem
+	// pending holds the expired items whose key is yet to be deleted by DeleteFn.
+	// Setting or removing the TTL of the key in the meantime cancels the deletion.
+	pending map[string]*TTLItem
+	wake    chan struct{}
+	// DeleteFn is called for every expired key, to delete it from the main store. The TTL of
+	// the key may be set or removed again while it runs, so the deletion is confirmed with
+	// ClaimExpired. It may be nil, in which case expired TTLs are only dropped and the keys
+	// are left alone.
 	DeleteFn func(key string)
+	// workerMu guards cancelWorker and workerDone, which stop the running worker
+	workerMu     sync.Mutex
+	cancelWorker context.CancelFunc
+	workerDone   chan struct{}
+	// activeExpire enables the background expiration of keys by the worker
+	activeExpire atomic.Bool
+	// cycleInterval and cycleBatch configure the periodic expire cycle, see SetExpireCycle
+	cycleInterval atomic.Int64
+	cycleBatch    atomic.Int64
 }
 
 // SetTTL sets the TTL for a key.
@@ -67,6 +85,9 @@ func (s *TTLStore) SetTTL(key string, expiresAt time.Time) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	// The key has been refreshed if its previous TTL is expired but not deleted yet
+	delete(s.pending, key)
+
 	// Overwrite existing key
 	if old, exists := s.entries[key]; exists {
 		heap.Remove(&s.heap, old.index)
@@ -81,10 +102,7 @@ func (s *TTLStore) SetTTL(key string, expiresAt time.Time) {
 	s.entries[key] = item
 
 	// Notify the worker to wake up
-	select {
-	case s.wake <- struct{}{}:
-	default:
-	}
+	s.wakeUp()
 }
 
 // GetTTL returns the expiration time for a key.
@@ -99,13 +117,171 @@ func (s *TTLStore) GetTTL(key string) (time.Time, bool) {
 	return item.ExpiresAt, true
 }
 
+// Expired reports whether the TTL of the key has passed, including when the key
+// has been picked up by the background expiration but not deleted yet
+func (s *TTLStore) Expired(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.pending[key]; ok {
+		return true
+	}
+	item, exists := s.entries[key]
+	return exists && !item.ExpiresAt.After(time.Now())
+}
+
+// Len returns the number of keys with a TTL
+func (s *TTLStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+// Snapshot returns a copy of the expiration times of all keys with a TTL.
+func (s *TTLStore) Snapshot() map[string]time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expires := make(map[string]time.Time, len(s.entries))
+	for key, item := range s.entries {
+		expires[key] = item.ExpiresAt
+	}
+	return expires
+}
+
+// DebugDump returns a copy of the TTLs in the heap, soonest first. It's meant for tests.
+func (s *TTLStore) DebugDump() []TTLItem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	items := make([]TTLItem, 0, len(s.heap))
+	for _, item := range s.heap {
+		items = append(items, TTLItem{Key: item.Key, ExpiresAt: item.ExpiresAt})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].ExpiresAt.Before(items[j].ExpiresAt) })
+	return items
+}
+
+// Remove drops the TTL of a key, reporting whether it had one.
+func (s *TTLStore) Remove(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pending, key)
+
+	item, exists := s.entries[key]
+	if !exists {
+		return false
+	}
+	heap.Remove(&s.heap, item.index)
+	delete(s.entries, key)
+	return true
+}
+
+// RemoveMany drops the TTLs of the keys under a single lock, returning the number of keys that had one.
+func (s *TTLStore) RemoveMany(keys []string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := 0
+	for _, key := range keys {
+		delete(s.pending, key)
+		if item, exists := s.entries[key]; exists {
+			heap.Remove(&s.heap, item.index)
+			delete(s.entries, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Peek returns the key closest to expiring.
+func (s *TTLStore) Peek() (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item := s.heap.Peek()
+	if item == nil {
+		return "", false
+	}
+	return item.Key, true
+}
+
+// Sample returns n randomly chosen keys with a TTL, or nil if no key has one.
+// The same key may be returned more than once.
+func (s *TTLStore) Sample(n int) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.heap) == 0 {
+		return nil
+	}
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = s.heap[rand.IntN(len(s.heap))].Key
+	}
+	return keys
+}
+
+// SetActiveExpire toggles the background expiration of keys.
+// When disabled, expired keys are only removed lazily on access.
+func (s *TTLStore) SetActiveExpire(enabled bool) {
+	s.activeExpire.Store(enabled)
+	// Let the worker pick up the change
+	s.wakeUp()
+}
+
+// SetExpireCycle switches the background expiration to periodic cycles: every interval,
+// at most batch keys past their expiration time are expired, soonest first. It caps the
+// work done at once when many keys expire at about the same time, at the cost of keys
+// outliving their TTL for up to an interval. A zero interval expires every key precisely
+// when its TTL passes, which is the default.
+func (s *TTLStore) SetExpireCycle(interval time.Duration, batch int) {
+	s.cycleInterval.Store(int64(interval))
+	s.cycleBatch.Store(int64(batch))
+	s.wakeUp()
+}
+
+// wakeUp signals the worker to re-evaluate the heap without blocking
+func (s *TTLStore) wakeUp() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
 // run is the background worker that continuously monitors and processes expired items.
 // It runs in a separate goroutine and handles three main scenarios:
 // 1. Empty heap: waits for new items or stop signal
 // 2. Items not yet expired: sleeps until next expiration or interruption
 // 3. Expired items: removes them from heap/map and calls DeleteFn callback
 func (s *TTLStore) run(ctx context.Context) {
+	// nextCycle is kept across wake signals, so that a stream of new TTLs doesn't postpone the expire cycle
+	var nextCycle time.Time
 	for {
+		// Wait for the active expiration to be re-enabled
+		if !s.activeExpire.Load() {
+			select {
+			case <-s.wake:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if interval := time.Duration(s.cycleInterval.Load()); interval > 0 {
+			if nextCycle.IsZero() {
+				nextCycle = time.Now().Add(interval)
+			}
+			select {
+			case <-time.After(time.Until(nextCycle)):
+				s.expire(int(s.cycleBatch.Load()))
+				nextCycle = time.Time{}
+			case <-s.wake:
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		nextCycle = time.Time{}
+
 		s.mu.Lock()
 		next := s.heap.Peek()
 		s.mu.Unlock()
@@ -132,25 +308,110 @@ func (s *TTLStore) run(ctx context.Context) {
 				return
 			}
 		}
-		// Expire items
-		s.mu.Lock()
-		// At this point we may have multiple items that are expired, iterate in a loop
-		for {
-			if s.heap.Len() == 0 || s.heap.Peek().ExpiresAt.After(time.Now()) {
-				break
-			}
-			item := heap.Pop(&s.heap).(*TTLItem)
-			delete(s.entries, item.Key)
-			if s.DeleteFn != nil {
-				go s.DeleteFn(item.Key)
-			}
+		// At this point we may have multiple items that are expired
+		s.expire(0)
+	}
+}
+
+// expire removes up to limit expired items, soonest first, and calls DeleteFn for them.
+// A non-positive limit removes all expired items.
+func (s *TTLStore) expire(limit int) {
+	for _, item := range s.popExpired(limit) {
+		go s.deleteExpired(item)
+	}
+}
+
+// popExpired removes up to limit expired items, soonest first, and returns
+// the ones whose key is pending deletion by DeleteFn
+func (s *TTLStore) popExpired(limit int) []*TTLItem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var expired []*TTLItem
+	now := time.Now()
+	for n := 0; limit <= 0 || n < limit; n++ {
+		if s.heap.Len() == 0 || s.heap.Peek().ExpiresAt.After(now) {
+			break
 		}
-		s.mu.Unlock()
+		item := heap.Pop(&s.heap).(*TTLItem)
+		delete(s.entries, item.Key)
+		if s.DeleteFn != nil {
+			s.pending[item.Key] = item
+			expired = append(expired, item)
+		}
+	}
+	return expired
+}
+
+// deleteExpired calls DeleteFn for the key of an expired item,
+// unless its TTL has been set or removed since it expired
+func (s *TTLStore) deleteExpired(item *TTLItem) {
+	s.mu.Lock()
+	pending := s.pending[item.Key] == item
+	s.mu.Unlock()
+	if !pending {
+		return
+	}
+	// DeleteFn may take other locks, which are held while calling into the TTLStore
+	s.DeleteFn(item.Key)
+
+	// The item is dropped even if DeleteFn hasn't claimed it
+	s.mu.Lock()
+	if s.pending[item.Key] == item {
+		delete(s.pending, item.Key)
 	}
+	s.mu.Unlock()
 }
 
+// ClaimExpired reports whether the key is pending deletion because its TTL has expired, in
+// which case the caller takes over the deletion. It fails if the TTL of the key has been set
+// or removed since it expired, or if the deletion has been claimed already.
+func (s *TTLStore) ClaimExpired(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.pending[key]; !ok {
+		return false
+	}
+	delete(s.pending, key)
+	return true
+}
+
+// Stop stops the background worker and waits for it to return. The TTLs are kept,
+// but keys aren't expired in the background until Restart is called.
 func (s *TTLStore) Stop() {
-	close(s.stop)
+	s.workerMu.Lock()
+	defer s.workerMu.Unlock()
+	s.stopWorker()
+}
+
+// Restart stops the background worker if it's running and starts a new one,
+// which runs until ctx is cancelled or Stop is called.
+func (s *TTLStore) Restart(ctx context.Context) {
+	s.workerMu.Lock()
+	defer s.workerMu.Unlock()
+	s.stopWorker()
+	s.startWorker(ctx)
+}
+
+// startWorker launches the background worker. Must be called with s.workerMu held.
+func (s *TTLStore) startWorker(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	s.cancelWorker, s.workerDone = cancel, done
+	go func() {
+		defer close(done)
+		s.run(ctx)
+	}()
+}
+
+// stopWorker stops the background worker if it's running. Must be called with s.workerMu held.
+func (s *TTLStore) stopWorker() {
+	if s.cancelWorker == nil {
+		return
+	}
+	s.cancelWorker()
+	<-s.workerDone
+	s.cancelWorker, s.workerDone = nil, nil
 }
 
 func (s *TTLStore) FlushAll() {
@@ -163,19 +424,24 @@ func (s *TTLStore) FlushAll() {
 
 	// Clear the entries map
 	s.entries = make(map[string]*TTLItem)
+	s.pending = make(map[string]*TTLItem)
+
+	// The worker may be sleeping until the deadline of a removed item
+	s.wakeUp()
 }
 
-// NewTTLStore creates a new TTL scheduler
+// NewTTLStore creates a new TTL scheduler, its background worker runs until ctx is cancelled or Stop is called
 func NewTTLStore(ctx context.Context, deleteFn func(key string)) *TTLStore {
 	s := &TTLStore{
 		heap:    TTLHeap{},
 		entries: make(map[string]*TTLItem),
+		pending: make(map[string]*TTLItem),
 		// Buffered channel up to 1 item to avoid blocking of the worker on wake signal
 		wake:     make(chan struct{}, 1),
-		stop:     make(chan struct{}),
 		DeleteFn: deleteFn,
 	}
 	heap.Init(&s.heap)
-	go s.run(ctx)
+	s.activeExpire.Store(true)
+	s.Restart(ctx)
 	return s
 }
@@ -0,0 +1,352 @@
+package ttlstore
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// deleted collects the keys expired by a TTLStore
+type deleted struct {
+	mu   sync.Mutex
+	keys map[string]time.Time
+}
+
+func (d *deleted) add(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.keys[key] = time.Now()
+}
+
+func (d *deleted) len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.keys)
+}
+
+func TestExpireCycle(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := &deleted{keys: make(map[string]time.Time)}
+	s := NewTTLStore(ctx, d.add)
+	s.SetExpireCycle(20*time.Millisecond, 2)
+
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		s.SetTTL("key:"+strconv.Itoa(i), start.Add(-time.Second))
+	}
+	s.SetTTL("later", start.Add(time.Hour))
+
+	// Every cycle expires a batch of two keys, so that all six are expired within three cycles
+	deadline := time.Now().Add(time.Second)
+	for d.len() < 6 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := d.len(); n != 6 {
+		t.Fatalf("expected 6 due keys to be expired, got %d", n)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("expected the work to be spread over several cycles, took %s", elapsed)
+	}
+	if _, ok := s.GetTTL("later"); !ok {
+		t.Errorf("expected the key that isn't due to be kept")
+	}
+}
+
+func TestExpireCyclePreciseByDefault(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := &deleted{keys: make(map[string]time.Time)}
+	s := NewTTLStore(ctx, d.add)
+	expiresAt := time.Now().Add(20 * time.Millisecond)
+	s.SetTTL("key", expiresAt)
+
+	deadline := time.Now().Add(time.Second)
+	for d.len() < 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	at, ok := d.keys["key"]
+	if !ok {
+		t.Fatalf("expected the key to be expired")
+	}
+	if at.Before(expiresAt) {
+		t.Errorf("expected the key not to be expired before its TTL")
+	}
+}
+
+func TestFlushAllWhileWorkerSleeps(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := &deleted{keys: make(map[string]time.Time)}
+	s := NewTTLStore(ctx, d.add)
+	s.SetTTL("flushed", time.Now().Add(50*time.Millisecond))
+	// Let the worker go to sleep until the deadline of the key
+	time.Sleep(10 * time.Millisecond)
+	s.FlushAll()
+
+	time.Sleep(100 * time.Millisecond)
+	if n := d.len(); n != 0 {
+		t.Fatalf("expected no expiration after the flush, got %d", n)
+	}
+
+	// The worker keeps serving the keys set after the flush
+	s.SetTTL("key", time.Now().Add(10*time.Millisecond))
+	deadline := time.Now().Add(time.Second)
+	for d.len() < 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := d.len(); n != 1 {
+		t.Errorf("expected the key set after the flush to be expired, got %d expirations", n)
+	}
+}
+
+func TestExpirationCancelledByRefresh(t *testing.T) {
+	tests := []struct {
+		name    string
+		refresh func(s *TTLStore)
+		deleted int
+	}{
+		{name: "not refreshed", refresh: func(s *TTLStore) {}, deleted: 1},
+		{name: "ttl extended", refresh: func(s *TTLStore) { s.SetTTL("key", time.Now().Add(time.Hour)) }, deleted: 0},
+		{name: "ttl removed", refresh: func(s *TTLStore) { s.Remove("key") }, deleted: 0},
+		{name: "ttl of another key removed", refresh: func(s *TTLStore) { s.RemoveMany([]string{"other"}) }, deleted: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &deleted{keys: make(map[string]time.Time)}
+			s := NewTTLStore(context.Background(), d.add)
+			s.Stop()
+			s.SetTTL("key", time.Now().Add(-time.Second))
+
+			// The key is refreshed between its expiration and its deletion
+			expired := s.popExpired(0)
+			tt.refresh(s)
+			for _, item := range expired {
+				s.deleteExpired(item)
+			}
+			if n := d.len(); n != tt.deleted {
+				t.Errorf("expected %d deleted keys, got %d", tt.deleted, n)
+			}
+		})
+	}
+}
+
+func TestClaimExpired(t *testing.T) {
+	tests := []struct {
+		name    string
+		refresh func(s *TTLStore)
+		claimed bool
+	}{
+		{name: "not refreshed", refresh: func(s *TTLStore) {}, claimed: true},
+		{name: "ttl extended", refresh: func(s *TTLStore) { s.SetTTL("key", time.Now().Add(time.Hour)) }, claimed: false},
+		{name: "ttl removed", refresh: func(s *TTLStore) { s.Remove("key") }, claimed: false},
+		{name: "claimed already", refresh: func(s *TTLStore) { s.ClaimExpired("key") }, claimed: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s *TTLStore
+			var claims []bool
+			// The key is refreshed while DeleteFn runs, e.g. by a command it waits for
+			s = NewTTLStore(context.Background(), func(key string) {
+				tt.refresh(s)
+				claims = append(claims, s.ClaimExpired(key))
+			})
+			s.Stop()
+			s.SetTTL("key", time.Now().Add(-time.Second))
+
+			for _, item := range s.popExpired(0) {
+				s.deleteExpired(item)
+			}
+			if len(claims) != 1 || claims[0] != tt.claimed {
+				t.Errorf("expected a single claim %v, got %v", tt.claimed, claims)
+			}
+			if s.ClaimExpired("key") {
+				t.Errorf("expected nothing left to claim")
+			}
+		})
+	}
+}
+
+func TestExpired(t *testing.T) {
+	tests := []struct {
+		name    string
+		refresh func(s *TTLStore)
+		expired bool
+	}{
+		{name: "pending", refresh: func(s *TTLStore) {}, expired: true},
+		{name: "ttl extended", refresh: func(s *TTLStore) { s.SetTTL("key", time.Now().Add(time.Hour)) }, expired: false},
+		{name: "ttl removed", refresh: func(s *TTLStore) { s.Remove("key") }, expired: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewTTLStore(context.Background(), func(string) {})
+			s.Stop()
+			s.SetTTL("key", time.Now().Add(-time.Second))
+			if !s.Expired("key") {
+				t.Fatalf("expected the key to be expired once its TTL has passed")
+			}
+
+			// The key is popped by the background expiration but not deleted yet
+			s.popExpired(0)
+			tt.refresh(s)
+			if got := s.Expired("key"); got != tt.expired {
+				t.Errorf("expected expired %v, got %v", tt.expired, got)
+			}
+		})
+	}
+}
+
+func TestExtendedTTLNotExpiredAtOldDeadline(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := &deleted{keys: make(map[string]time.Time)}
+	s := NewTTLStore(ctx, d.add)
+	s.SetTTL("key", time.Now().Add(20*time.Millisecond))
+	s.SetTTL("key", time.Now().Add(time.Hour))
+
+	time.Sleep(100 * time.Millisecond)
+	if n := d.len(); n != 0 {
+		t.Errorf("expected the key not to be deleted at its old deadline, got %d deletions", n)
+	}
+	if _, ok := s.GetTTL("key"); !ok {
+		t.Errorf("expected the extended TTL to be kept")
+	}
+}
+
+func TestNilDeleteFn(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := NewTTLStore(ctx, nil)
+	s.SetTTL("key", time.Now().Add(10*time.Millisecond))
+	s.SetTTL("other", time.Now().Add(time.Hour))
+
+	deadline := time.Now().Add(time.Second)
+	for s.Len() > 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, ok := s.GetTTL("key"); ok {
+		t.Errorf("expected the expired TTL to be dropped")
+	}
+	if _, ok := s.GetTTL("other"); !ok {
+		t.Errorf("expected the other TTL to be kept")
+	}
+	s.FlushAll()
+	if n := s.Len(); n != 0 {
+		t.Errorf("expected no TTL after the flush, got %d", n)
+	}
+}
+
+func TestStopAndRestart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := &deleted{keys: make(map[string]time.Time)}
+	s := NewTTLStore(ctx, d.add)
+	s.Stop()
+	// Stopping twice is a no-op
+	s.Stop()
+	s.SetTTL("key", time.Now().Add(10*time.Millisecond))
+
+	time.Sleep(50 * time.Millisecond)
+	if n := d.len(); n != 0 {
+		t.Fatalf("expected no expiration while stopped, got %d", n)
+	}
+
+	s.Restart(ctx)
+	deadline := time.Now().Add(time.Second)
+	for d.len() < 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := d.len(); n != 1 {
+		t.Errorf("expected the key to be expired once restarted, got %d expirations", n)
+	}
+	if _, ok := s.GetTTL("key"); ok {
+		t.Errorf("expected the TTL to be removed once expired")
+	}
+}
+
+func TestRemoveMany(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := NewTTLStore(ctx, func(string) {})
+	expiresAt := time.Now().Add(time.Hour)
+	for _, key := range []string{"a", "b", "c"} {
+		s.SetTTL(key, expiresAt)
+	}
+	if n := s.RemoveMany([]string{"a", "c", "missing"}); n != 2 {
+		t.Errorf("expected 2 removed TTLs, got %d", n)
+	}
+	if n := s.Len(); n != 1 {
+		t.Errorf("expected a single TTL left, got %d", n)
+	}
+	if key, ok := s.Peek(); !ok || key != "b" {
+		t.Errorf("expected b to be left in the heap, got %q", key)
+	}
+}
+
+func TestDebugDump(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := NewTTLStore(ctx, func(string) {})
+	now := time.Now().Add(time.Hour)
+	for i, offset := range []int{5, 1, 4, 2, 6, 3, 0} {
+		s.SetTTL("key"+strconv.Itoa(i), now.Add(time.Duration(offset)*time.Minute))
+	}
+	// Overwriting and removing TTLs keep the heap consistent
+	s.SetTTL("key4", now.Add(-time.Minute))
+	s.Remove("key2")
+
+	var keys []string
+	items := s.DebugDump()
+	for i, item := range items {
+		keys = append(keys, item.Key)
+		if i > 0 && item.ExpiresAt.Before(items[i-1].ExpiresAt) {
+			t.Errorf("expected the items to be ordered by expiry, got %s before %s", items[i-1].Key, item.Key)
+		}
+	}
+	if expected := "key4 key6 key1 key3 key5 key0"; strings.Join(keys, " ") != expected {
+		t.Errorf("expected %q, got %q", expected, strings.Join(keys, " "))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, item := range s.heap {
+		if item.index != i {
+			t.Errorf("expected %s to be at index %d, got %d", item.Key, i, item.index)
+		}
+		if parent := (i - 1) / 2; i > 0 && s.heap.Less(i, parent) {
+			t.Errorf("expected %s to expire after its parent %s", item.Key, s.heap[parent].Key)
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := NewTTLStore(ctx, func(string) {})
+	expiresAt := time.Now().Add(time.Hour)
+	s.SetTTL("a", expiresAt)
+	s.SetTTL("b", expiresAt)
+	snapshot := s.Snapshot()
+
+	s.SetTTL("a", expiresAt.Add(time.Hour))
+	s.Remove("b")
+	s.SetTTL("c", expiresAt)
+
+	if len(snapshot) != 2 || !snapshot["a"].Equal(expiresAt) || !snapshot["b"].Equal(expiresAt) {
+		t.Errorf("expected the snapshot to be unaffected by later changes, got %v", snapshot)
+	}
+}